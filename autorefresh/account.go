@@ -1,12 +1,11 @@
 package autorefresh
 
 import (
+	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"strings"
 	"time"
@@ -14,11 +13,28 @@ import (
 
 const RETRYCOUNT = 10
 
+var POLL_INTERVAL = 5 * time.Second
+
 type Account struct {
-	Name            string
-	AccessKeyId     string
-	OwnerId         string
-	SecretAccessKey string
+	Name                 string
+	AccessKeyId          string
+	OwnerId              string
+	SecretAccessKey      string
+	CredentialSource     string
+	Profile              string
+	CredentialsFile      string
+	WebIdentityRoleArn   string
+	WebIdentityTokenFile string
+	RoleArn              string
+	ExternalId           string
+	RoleSessionName      string
+	Http                 HttpConfig
+	Partition            string
+	Ec2Endpoint          string
+	ClientFactory        Ec2ClientFactory         `json:"-"`
+	S3Factory            S3ClientFactory          `json:"-"`
+	AutoscalingFactory   AutoscalingClientFactory `json:"-"`
+	origin               configOrigin
 }
 
 func (self *Account) getLogFields() map[string]interface{} {
@@ -27,6 +43,13 @@ func (self *Account) getLogFields() map[string]interface{} {
 	return logFields
 }
 
+func (self *Account) wrapError(kind ErrorKind, op string, region string, err error) error {
+	e := newError(kind, op, err)
+	e.Account = self.Name
+	e.Region = region
+	return e
+}
+
 func (self *Account) validateAndSetDefaults() error {
 	self.Name = strings.TrimSpace(self.Name)
 	self.AccessKeyId = strings.TrimSpace(self.AccessKeyId)
@@ -36,39 +59,66 @@ func (self *Account) validateAndSetDefaults() error {
 	if self.Name == "" {
 		missingFields = append(missingFields, "Name")
 	}
-	if self.AccessKeyId == "" {
-		missingFields = append(missingFields, "AccessKeyId")
-	}
 	if self.OwnerId == "" {
 		missingFields = append(missingFields, "OwnerId")
 	}
-	if self.SecretAccessKey == "" {
-		missingFields = append(missingFields, "SecretAccessKey")
-	}
 	if len(missingFields) > 0 {
 		message := fmt.Sprintf("Mandatory fields missing in Account: %v", strings.Join(missingFields, ", "))
 		return errors.New(message)
 	}
-	return nil
+	if err := self.Http.validateAndSetDefaults(); err != nil {
+		return fmt.Errorf("%v in Account '%v'", err, self.Name)
+	}
+	if err := self.validateEndpoint(); err != nil {
+		return err
+	}
+	return self.validateCredentials()
+}
+
+func (self *Account) ConnectToRegion(region string) (Ec2Client, error) {
+	if self.ClientFactory != nil {
+		return self.ClientFactory(self, region), nil
+	}
+	connection, err := sessionCache.ec2(self, region)
+	if err != nil {
+		log.WithFields(self.getLogFields()).Errorf("Unable to create AWS session, message: %v", err)
+		return nil, err
+	}
+	return connection, nil
 }
 
-func (self *Account) ConnectToRegion(region string) *ec2.EC2 {
-	provider := credentials.StaticProvider{
-		Value: credentials.Value{
-			AccessKeyID:     self.AccessKeyId,
-			SecretAccessKey: self.SecretAccessKey,
-		},
-	}
-	connection := ec2.New(
-		session.New(
-			&aws.Config{Credentials: credentials.NewCredentials(&provider)},
-		),
-		&aws.Config{Region: aws.String(region)},
-	)
-	return connection
+// ConnectToAutoscaling returns the Auto Scaling client of the region. With
+// Ec2Endpoint set it returns nil instead, Auto Scaling is not served there and
+// its users are not checked.
+func (self *Account) ConnectToAutoscaling(region string) (AutoscalingClient, error) {
+	if self.AutoscalingFactory != nil {
+		return self.AutoscalingFactory(self, region), nil
+	}
+	if self.Ec2Endpoint != "" {
+		log.WithFields(self.getLogFields()).Debugf("Ec2Endpoint set, Auto Scaling not checked on Region: %v", region)
+		return nil, nil
+	}
+	connection, err := sessionCache.autoscaling(self, region)
+	if err != nil {
+		log.WithFields(self.getLogFields()).Errorf("Unable to create AWS session, message: %v", err)
+		return nil, err
+	}
+	return connection, nil
 }
 
-func (self *Account) LaunchInstance(config *LaunchConfig) (*AutoInstance, error) {
+func (self *Account) ConnectToS3(region string) (S3Client, error) {
+	if self.S3Factory != nil {
+		return self.S3Factory(self, region), nil
+	}
+	connection, err := sessionCache.s3(self, region)
+	if err != nil {
+		log.WithFields(self.getLogFields()).Errorf("Unable to create AWS session, message: %v", err)
+		return nil, err
+	}
+	return connection, nil
+}
+
+func (self *Account) LaunchInstance(ctx context.Context, config *LaunchConfig) (*AutoInstance, error) {
 	var deviceMappings []*ec2.BlockDeviceMapping
 	for _, ebsConfig := range config.Ebs {
 		// Initialize
@@ -96,11 +146,17 @@ func (self *Account) LaunchInstance(config *LaunchConfig) (*AutoInstance, error)
 	input.BlockDeviceMappings = deviceMappings
 	log.WithFields(self.getLogFields()).Infof("Launching %v instance with AMI ID: %v on Region: %v",
 		config.InstanceType, config.Source.AmiId, config.Source.Region)
-	connection := self.ConnectToRegion(config.Source.Region)
+	if err := ctx.Err(); err != nil {
+		return nil, self.wrapError(LaunchError, "RunInstances", config.Source.Region, err)
+	}
+	connection, err := self.ConnectToRegion(config.Source.Region)
+	if err != nil {
+		return nil, self.wrapError(LaunchError, "ConnectToRegion", config.Source.Region, err)
+	}
 	runResult, err := connection.RunInstances(input)
 	if err != nil {
 		log.WithFields(self.getLogFields()).Errorf("Launch failed with AMI ID: %v", config.Source.AmiId)
-		return nil, err
+		return nil, self.wrapError(LaunchError, "RunInstances", config.Source.Region, err)
 	}
 	instance := runResult.Instances[0]
 	autoInstance := AutoInstance{}
@@ -117,11 +173,15 @@ func (self *Account) LaunchInstance(config *LaunchConfig) (*AutoInstance, error)
 		}
 		log.WithFields(self.getLogFields()).Warningf(
 			"Instancd tagging failed for instance: %v, Try # %v", autoInstance.Id, i+1)
-		time.Sleep(5 * time.Second)
+		if err = sleepWithContext(ctx, POLL_INTERVAL); err != nil {
+			break
+		}
 	}
 	if err != nil {
 		log.WithFields(self.getLogFields()).Errorf("Instancd tagging failed for instance: %v", autoInstance.Id)
-		return nil, err
+		// Untagged builders are invisible to CleanUp, never leave one behind
+		autoInstance.Terminate()
+		return nil, self.wrapError(LaunchError, "TagInstance", config.Source.Region, err)
 	}
 	return &autoInstance, nil
 }
@@ -134,21 +194,22 @@ func (self *Account) FindInstances(config *LaunchConfig) (*[]AutoInstance, error
 			Values: []*string{aws.String(value)},
 		})
 	}
-	connection := self.ConnectToRegion(config.Source.Region)
-	resp, err := connection.DescribeInstances(input)
+	connection, err := self.ConnectToRegion(config.Source.Region)
+	if err != nil {
+		return nil, self.wrapError(CleanUpError, "ConnectToRegion", config.Source.Region, err)
+	}
+	instances, err := describeAllInstances(connection, input)
 	if err != nil {
 		log.WithFields(self.getLogFields()).Error(err)
-		return nil, err
+		return nil, self.wrapError(CleanUpError, "DescribeInstances", config.Source.Region, err)
 	}
 
 	instancesFound := make([]AutoInstance, 0)
-	for _, reservation := range resp.Reservations {
-		for _, instance := range reservation.Instances {
-			aI := AutoInstance{}
-			aI.Connection = connection
-			aI.Update(instance)
-			instancesFound = append(instancesFound, aI)
-		}
+	for _, instance := range instances {
+		aI := AutoInstance{}
+		aI.Connection = connection
+		aI.Update(instance)
+		instancesFound = append(instancesFound, aI)
 	}
 	return &instancesFound, nil
 }
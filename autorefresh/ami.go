@@ -1,23 +1,58 @@
 package autorefresh
 
 import (
+	"context"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"sort"
+	"strings"
 	"time"
 )
 
 type AutoAmi struct {
-	Id           string
-	Region       string
-	Architecture string
-	Name         string
-	State        string
-	Description  string
-	CreationDate string
-	Tags         map[string]string
-	Connection   *ec2.EC2
+	Id                  string
+	Region              string
+	Architecture        string
+	Name                string
+	State               string
+	Description         string
+	CreationDate        string
+	OwnerId             string
+	RootDeviceName      string
+	RootDeviceType      string
+	VirtualizationType  string
+	EnaSupport          bool
+	BlockDeviceMappings []AmiBlockDevice
+	Tags                map[string]string
+	Connection          Ec2Client
+	Autoscaling         AutoscalingClient
+}
+
+type AmiBlockDevice struct {
+	DeviceName          string
+	VirtualName         string
+	NoDevice            bool
+	SnapshotId          string
+	VolumeSize          int64
+	VolumeType          string
+	DeleteOnTermination bool
+	Encrypted           bool
+}
+
+func extractAmiBlockDevice(mapping *ec2.BlockDeviceMapping) AmiBlockDevice {
+	device := AmiBlockDevice{}
+	device.DeviceName = aws.StringValue(mapping.DeviceName)
+	device.VirtualName = aws.StringValue(mapping.VirtualName)
+	device.NoDevice = mapping.NoDevice != nil
+	if mapping.Ebs != nil {
+		device.SnapshotId = aws.StringValue(mapping.Ebs.SnapshotId)
+		device.VolumeSize = aws.Int64Value(mapping.Ebs.VolumeSize)
+		device.VolumeType = aws.StringValue(mapping.Ebs.VolumeType)
+		device.DeleteOnTermination = aws.BoolValue(mapping.Ebs.DeleteOnTermination)
+		device.Encrypted = aws.BoolValue(mapping.Ebs.Encrypted)
+	}
+	return device
 }
 
 func (self *AutoAmi) getLogFields() map[string]interface{} {
@@ -30,17 +65,32 @@ func (self *AutoAmi) getLogFields() map[string]interface{} {
 }
 
 func (self *AutoAmi) Update(image *ec2.Image) {
-	self.Architecture = *image.Architecture
-	self.CreationDate = *image.CreationDate
-	self.Description = *image.Description
-	self.Id = *image.ImageId
-	self.Name = *image.Name
-	self.State = *image.State
+	self.Architecture = aws.StringValue(image.Architecture)
+	self.CreationDate = aws.StringValue(image.CreationDate)
+	self.Description = aws.StringValue(image.Description)
+	self.Id = aws.StringValue(image.ImageId)
+	self.Name = aws.StringValue(image.Name)
+	self.State = aws.StringValue(image.State)
+	self.OwnerId = aws.StringValue(image.OwnerId)
+	self.RootDeviceName = aws.StringValue(image.RootDeviceName)
+	self.RootDeviceType = aws.StringValue(image.RootDeviceType)
+	self.VirtualizationType = aws.StringValue(image.VirtualizationType)
+	self.EnaSupport = aws.BoolValue(image.EnaSupport)
+	self.BlockDeviceMappings = make([]AmiBlockDevice, 0)
+	for _, mapping := range image.BlockDeviceMappings {
+		if mapping == nil {
+			continue
+		}
+		self.BlockDeviceMappings = append(self.BlockDeviceMappings, extractAmiBlockDevice(mapping))
+	}
 	if self.Tags == nil {
 		self.Tags = make(map[string]string)
 	}
 	for _, tag := range image.Tags {
-		self.Tags[*tag.Key] = *tag.Value
+		if tag == nil || tag.Key == nil {
+			continue
+		}
+		self.Tags[*tag.Key] = aws.StringValue(tag.Value)
 	}
 }
 
@@ -51,6 +101,9 @@ func (self *AutoAmi) IsAvailable() (bool, error) {
 	if err != nil {
 		return false, err
 	}
+	if len(resp.Images) == 0 {
+		return false, fmt.Errorf("AMI %v not found", self.Id)
+	}
 	image := resp.Images[0]
 	self.Update(image)
 	if self.State == "available" {
@@ -60,7 +113,7 @@ func (self *AutoAmi) IsAvailable() (bool, error) {
 	}
 }
 
-func (self *AutoAmi) WaitForAvailableState() error {
+func (self *AutoAmi) WaitForAvailableState(ctx context.Context) error {
 	for self.State != "available" {
 		_, err := self.IsAvailable()
 		if err != nil {
@@ -69,7 +122,10 @@ func (self *AutoAmi) WaitForAvailableState() error {
 		}
 		if self.State != "available" {
 			log.WithFields(self.getLogFields()).Debug("Waiting for AMI to be ready")
-			time.Sleep(5 * time.Second)
+			if err := sleepWithContext(ctx, POLL_INTERVAL); err != nil {
+				log.WithFields(self.getLogFields()).Warningf("Stopped waiting for AMI, message: %v", err)
+				return err
+			}
 		} else {
 			log.WithFields(self.getLogFields()).Info("AMI is now ready!")
 		}
@@ -96,6 +152,18 @@ func (self *AutoAmi) TagImage() error {
 	return nil
 }
 
+func (self *AutoAmi) Deregister() error {
+	input := new(ec2.DeregisterImageInput)
+	input.ImageId = aws.String(self.Id)
+	_, err := self.Connection.DeregisterImage(input)
+	if err != nil {
+		log.WithFields(self.getLogFields()).Errorf("AMI delete API failed, message: %v", err)
+		return err
+	}
+	log.WithFields(self.getLogFields()).Info("AMI deregistered")
+	return nil
+}
+
 func extractAutoAmi(image *ec2.Image) AutoAmi {
 	ami := AutoAmi{}
 	ami.Update(image)
@@ -104,11 +172,13 @@ func extractAutoAmi(image *ec2.Image) AutoAmi {
 
 type ByTimeReverse []*ec2.Image
 
-func (a ByTimeReverse) Len() int           { return len(a) }
-func (a ByTimeReverse) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
-func (a ByTimeReverse) Less(i, j int) bool { return *a[i].CreationDate > *a[j].CreationDate }
+func (a ByTimeReverse) Len() int      { return len(a) }
+func (a ByTimeReverse) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a ByTimeReverse) Less(i, j int) bool {
+	return aws.StringValue(a[i].CreationDate) > aws.StringValue(a[j].CreationDate)
+}
 
-func (self *AutoAmi) findAmi(owner string) (amiFound []*AutoAmi) {
+func (self *AutoAmi) findAmi(owner string) (amiFound []*AutoAmi, err error) {
 	input := new(ec2.DescribeImagesInput)
 	input.Owners = append(input.Owners, aws.String(owner))
 	for key, value := range self.Tags {
@@ -117,36 +187,128 @@ func (self *AutoAmi) findAmi(owner string) (amiFound []*AutoAmi) {
 			Values: []*string{aws.String(value)},
 		})
 	}
-	resp, err := self.Connection.DescribeImages(input)
+	images, err := describeAllImages(self.Connection, input)
 	if err != nil {
-		panic(err)
+		log.WithFields(self.getLogFields()).Errorf("AMI search API failed, message: %v", err)
+		return nil, err
 	}
-	images := resp.Images
 	sort.Sort(ByTimeReverse(images))
 	for _, image := range images {
 		ami := extractAutoAmi(image)
 		amiFound = append(amiFound, &ami)
 	}
-	return amiFound
+	return amiFound, nil
+}
+
+// DeleteSnapshots deletes the EBS snapshots backing a deregistered image,
+// except those still used by another image of owner, and returns the GiB
+// reclaimed. Failures are logged only.
+func (self *AutoAmi) DeleteSnapshots(owner string) int64 {
+	var reclaimed int64
+	for _, device := range self.BlockDeviceMappings {
+		if device.SnapshotId == "" {
+			continue
+		}
+		input := new(ec2.DescribeImagesInput)
+		input.Owners = append(input.Owners, aws.String(owner))
+		input.Filters = append(input.Filters, &ec2.Filter{
+			Name:   aws.String("block-device-mapping.snapshot-id"),
+			Values: []*string{aws.String(device.SnapshotId)},
+		})
+		images, err := describeAllImages(self.Connection, input)
+		if err != nil {
+			log.WithFields(self.getLogFields()).Warningf("Snapshot %v kept, image search API failed, message: %v",
+				device.SnapshotId, err)
+			continue
+		}
+		shared := false
+		for _, image := range images {
+			if aws.StringValue(image.ImageId) != self.Id {
+				shared = true
+			}
+		}
+		if shared {
+			log.WithFields(self.getLogFields()).Infof("Snapshot %v kept, it is used by another AMI", device.SnapshotId)
+			continue
+		}
+		deleteInput := new(ec2.DeleteSnapshotInput)
+		deleteInput.SnapshotId = aws.String(device.SnapshotId)
+		if _, err := self.Connection.DeleteSnapshot(deleteInput); err != nil {
+			log.WithFields(self.getLogFields()).Warningf("Snapshot delete API failed for %v, message: %v",
+				device.SnapshotId, err)
+			continue
+		}
+		log.WithFields(self.getLogFields()).Infof("Deleted snapshot: %v, %v GiB", device.SnapshotId, device.VolumeSize)
+		reclaimed += device.VolumeSize
+	}
+	return reclaimed
 }
 
-func (self *AutoAmi) DeleteOldAmi(owner string, retentionCount uint) (deletedImages []*AutoAmi) {
-	amiFound := self.findAmi(owner)
-	for i := len(amiFound) - 1; i >= int(retentionCount); i-- {
-		if amiFound[i].State != "available" {
-			retentionCount++
+// DeleteOldAmi deregisters the images the retention policy no longer keeps.
+// Images still in use are kept and tagged with TAG_IN_USE instead, the tag is
+// removed from the images kept that are no longer in use. With
+// deleteSnapshots set the EBS snapshots of deregistered images are deleted as
+// well.
+func (self *AutoAmi) DeleteOldAmi(owner string, policy *RetentionPolicy, deleteSnapshots bool) (deletedImages []*AutoAmi, err error) {
+	amiFound, err := self.findAmi(owner)
+	if err != nil {
+		return nil, &Error{Kind: RetentionError, Op: "DescribeImages", Region: self.Region, Err: err}
+	}
+	candidates, inUse, users, err := self.expiredImages(amiFound, policy, time.Now())
+	if err != nil {
+		return nil, &Error{Kind: RetentionError, Op: "ImagesInUse", Region: self.Region, Err: err}
+	}
+	for _, ami := range inUse {
+		log.WithFields(self.getLogFields()).Warningf("AMI %v kept, still in use by %v",
+			ami.Id, strings.Join(users[ami.Id], ", "))
+		ami.Connection = self.Connection
+		if err := ami.markInUse(users[ami.Id]); err != nil {
+			log.WithFields(self.getLogFields()).Warningf("Tagging AMI %v as in use failed, message: %v", ami.Id, err)
+		}
+	}
+	// Expired images not in use are deregistered below, the tag goes with them
+	expired := make(map[string]bool)
+	for _, ami := range append(inUse, candidates...) {
+		expired[ami.Id] = true
+	}
+	for _, ami := range amiFound {
+		if _, ok := ami.Tags[TAG_IN_USE]; !ok || expired[ami.Id] {
+			continue
+		}
+		ami.Connection = self.Connection
+		if err := ami.clearInUse(); err != nil {
+			log.WithFields(self.getLogFields()).Warningf("Untagging AMI %v no longer in use failed, message: %v",
+				ami.Id, err)
 			continue
 		}
+		log.WithFields(self.getLogFields()).Infof("AMI %v no longer in use", ami.Id)
+	}
+	var reclaimed int64
+	failures := make(ErrorList, 0)
+	for _, ami := range candidates {
 		input := new(ec2.DeregisterImageInput)
-		input.ImageId = aws.String(amiFound[i].Id)
+		input.ImageId = aws.String(ami.Id)
 		_, err := self.Connection.DeregisterImage(input)
 		if err != nil {
 			log.WithFields(self.getLogFields()).Warningf("AMI delete API failed, message: %v", err)
+			failures = append(failures, &Error{Kind: RetentionError, Op: "DeregisterImage", Region: self.Region,
+				Err: fmt.Errorf("AMI %v: %v", ami.Id, err)})
+			continue
 		}
-		deletedImages = append(deletedImages, amiFound[i])
+		if deleteSnapshots {
+			ami.Connection = self.Connection
+			reclaimed += ami.DeleteSnapshots(owner)
+		}
+		deletedImages = append(deletedImages, ami)
 	}
 	for _, ami := range deletedImages {
 		log.WithFields(self.getLogFields()).Infof("Deleted AMI: %v", ami.Id)
 	}
-	return deletedImages
+	if deleteSnapshots && len(deletedImages) > 0 {
+		log.WithFields(self.getLogFields()).Infof("Reclaimed %v GiB of EBS snapshots", reclaimed)
+	}
+	if len(failures) > 0 {
+		return deletedImages, failures
+	}
+	return deletedImages, nil
 }
@@ -0,0 +1,115 @@
+package autorefresh
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"os"
+	"testing"
+	"time"
+)
+
+func testSnapshotMapping(device string, snapshotId string, size int64) *ec2.BlockDeviceMapping {
+	return &ec2.BlockDeviceMapping{
+		DeviceName: aws.String(device),
+		Ebs:        &ec2.EbsBlockDevice{SnapshotId: aws.String(snapshotId), VolumeSize: aws.Int64(size)},
+	}
+}
+
+func TestDeleteSnapshots(t *testing.T) {
+	tests := []struct {
+		name      string
+		shared    bool
+		errors    []string
+		reclaimed int64
+		deletes   int
+		deleted   []string
+		kept      []string
+	}{
+		{"unshared snapshot deleted", false, nil, 8, 1, []string{"snap-own"}, nil},
+		{"snapshot of another image kept", true, nil, 8, 1, []string{"snap-own"}, []string{"snap-shared"}},
+		{"failed delete not counted", true, []string{"DeleteSnapshot"}, 0, 1, nil,
+			[]string{"snap-own", "snap-shared"}},
+		{"failed image search keeps all", true, []string{"DescribeImages"}, 0, 0, nil,
+			[]string{"snap-own", "snap-shared"}},
+	}
+	for _, test := range tests {
+		fake := NewFakeEc2("111111111111")
+		mappings := []*ec2.BlockDeviceMapping{testSnapshotMapping("/dev/xvda", "snap-own", 8)}
+		if test.shared {
+			mappings = append(mappings, testSnapshotMapping("/dev/xvdb", "snap-shared", 20))
+			fake.AddImage(&ec2.Image{
+				BlockDeviceMappings: []*ec2.BlockDeviceMapping{testSnapshotMapping("/dev/xvda", "snap-shared", 20)},
+			})
+		}
+		id := fake.AddImage(&ec2.Image{BlockDeviceMappings: mappings})
+		ami := AutoAmi{}
+		ami.Update(fake.Image(id))
+		ami.Connection = fake
+		if _, err := fake.DeregisterImage(&ec2.DeregisterImageInput{ImageId: aws.String(id)}); err != nil {
+			t.Fatal(err)
+		}
+		for _, operation := range test.errors {
+			fake.Errors[operation] = awserr.New("InternalError", "failed", nil)
+		}
+
+		if reclaimed := ami.DeleteSnapshots(fake.OwnerId); reclaimed != test.reclaimed {
+			t.Errorf("%v: reclaimed %v GiB, expected %v", test.name, reclaimed, test.reclaimed)
+		}
+		if fake.Calls("DeleteSnapshot") != test.deletes {
+			t.Errorf("%v: DeleteSnapshot called %v times, expected %v", test.name, fake.Calls("DeleteSnapshot"),
+				test.deletes)
+		}
+		for _, snapshot := range test.deleted {
+			if fake.Snapshot(snapshot) {
+				t.Errorf("%v: snapshot %v kept", test.name, snapshot)
+			}
+		}
+		for _, snapshot := range test.kept {
+			if !fake.Snapshot(snapshot) {
+				t.Errorf("%v: snapshot %v deleted", test.name, snapshot)
+			}
+		}
+	}
+}
+
+func TestPruneKeepSnapshots(t *testing.T) {
+	for _, keepSnapshots := range []bool{false, true} {
+		fake := NewFakeEc2("111111111111")
+		job := newTestJob(t, fake)
+		job.KeepSnapshots = keepSnapshots
+		created := time.Now().UTC().Add(-72 * time.Hour)
+		snapshots := []string{"snap-1", "snap-2", "snap-3"}
+		for i, snapshot := range snapshots {
+			fake.AddImage(&ec2.Image{
+				CreationDate: aws.String(created.Add(time.Duration(i) * time.Hour).Format(time.RFC3339)),
+				Tags:         testTags(job.LaunchConfig.Tags),
+				BlockDeviceMappings: []*ec2.BlockDeviceMapping{
+					testSnapshotMapping("/dev/xvda", snapshot, 8),
+				},
+			})
+		}
+
+		deleted, err := job.Prune(context.Background(), false)
+		os.RemoveAll(job.ConsoleOutput.Directory)
+		if err != nil || len(deleted) != 1 {
+			t.Fatalf("KeepSnapshots %v: deleted %v, error %v", keepSnapshots, deleted, err)
+		}
+		expected := 1
+		if keepSnapshots {
+			expected = 0
+		}
+		if fake.Calls("DeleteSnapshot") != expected {
+			t.Errorf("KeepSnapshots %v: DeleteSnapshot called %v times", keepSnapshots, fake.Calls("DeleteSnapshot"))
+		}
+		if fake.Snapshot("snap-1") == (expected == 1) {
+			t.Errorf("KeepSnapshots %v: snapshot of the deleted AMI left %v", keepSnapshots, fake.Snapshot("snap-1"))
+		}
+		for _, snapshot := range snapshots[1:] {
+			if !fake.Snapshot(snapshot) {
+				t.Errorf("KeepSnapshots %v: snapshot %v of a kept AMI deleted", keepSnapshots, snapshot)
+			}
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package autorefresh
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// buildJobs returns the jobs of the named project, narrowed to region and
+// sourceAmiId when they are not empty.
+func (self *ConfigStorage) buildJobs(name string, region string, sourceAmiId string) ([]AutoRefreshAmi, error) {
+	project, ok := self.projects[name]
+	if !ok {
+		return nil, &Error{Kind: ConfigError, Op: "BuildProject", Project: name,
+			Err: fmt.Errorf("Project '%v' is not defined", name)}
+	}
+	jobs, err := self.projectJobs(project)
+	if err != nil {
+		return nil, err
+	}
+	selected := make([]AutoRefreshAmi, 0)
+	for _, job := range jobs {
+		if region != "" && job.LaunchConfig.Source.Region != region {
+			continue
+		}
+		if sourceAmiId != "" && job.LaunchConfig.Source.AmiId != sourceAmiId {
+			continue
+		}
+		selected = append(selected, job)
+	}
+	if len(selected) == 0 {
+		return nil, &Error{Kind: ConfigError, Op: "BuildProject", Project: name, Region: region,
+			Err: fmt.Errorf("No source of Project '%v' matches region '%v' and source AMI '%v'",
+				name, region, sourceAmiId)}
+	}
+	return selected, nil
+}
+
+// BuildProject runs Refresh once, right away, for every source of the named
+// project, optionally narrowed to a region and a source AMI. It returns once
+// all of them are done, with one result per source. The error is a
+// ConfigError when nothing matches, otherwise an ErrorList of the failed
+// refreshes.
+func BuildProject(ctx context.Context, cs *ConfigStorage, name string, region string,
+	sourceAmiId string) ([]*RefreshResult, error) {
+	jobs, err := cs.buildJobs(name, region, sourceAmiId)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// Listen until the builds return, a first signal only cancels ctx
+	listenCtx, stopListening := context.WithCancel(context.Background())
+	defer stopListening()
+	go receiveSystemSignals(listenCtx, cancel, true)
+
+	results := make([]*RefreshResult, len(jobs))
+	refreshErrors := make([]error, len(jobs))
+	// Refresh signals the job wait group itself, before its results are
+	// handed back, so completion is tracked separately.
+	jobGroup := sync.WaitGroup{}
+	waitGroup := sync.WaitGroup{}
+	for index := range jobs {
+		job := &jobs[index]
+		// Scheduling does not apply to an on-demand build
+		job.Cron = ""
+		job.waitGroup = &jobGroup
+		jobGroup.Add(1)
+		waitGroup.Add(1)
+		go func(index int) {
+			defer waitGroup.Done()
+			results[index], refreshErrors[index] = job.Refresh(ctx)
+		}(index)
+	}
+	waitGroup.Wait()
+
+	failures := make(ErrorList, 0)
+	for _, err := range refreshErrors {
+		if err != nil {
+			failures = append(failures, err)
+		}
+	}
+	if len(failures) > 0 {
+		return results, failures
+	}
+	return results, nil
+}
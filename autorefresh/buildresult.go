@@ -0,0 +1,94 @@
+package autorefresh
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// The user data script is wrapped so that, whatever it does, the builder
+// prints exactly one of these markers to its console before shutting down.
+// Refresh only creates an AMI after reading BUILD_RESULT_SUCCESS.
+const BUILD_RESULT_MARKER = "AUTOREFRESH-AMI-BUILD-RESULT:"
+const BUILD_RESULT_SUCCESS = "SUCCESS"
+const BUILD_RESULT_FAILURE = "FAILURE"
+
+const BUILD_SCRIPT_PATH = "/var/tmp/autorefresh-ami-build.sh"
+const BUILD_SCRIPT_DELIMITER = "__AUTOREFRESH_AMI_BUILD_SCRIPT__"
+
+var ErrBuildResultMissing = errors.New("build result marker not found in console output")
+
+// BuildScriptFailure is returned when the user data script reported an error.
+type BuildScriptFailure struct {
+	Detail string
+}
+
+func (self *BuildScriptFailure) Error() string {
+	if self.Detail == "" {
+		return "user data script failed"
+	}
+	return fmt.Sprintf("user data script failed: %v", self.Detail)
+}
+
+// wrapUserData turns a user data script into the builder script: it runs the
+// user script, reports its exit status on the console and shuts down. Scripts
+// already wrapped are returned as is. The heredoc delimiter is changed until
+// the user script does not contain it.
+func wrapUserData(script string) string {
+	header := fmt.Sprintf("#!/bin/bash\ncat > %v <<'", BUILD_SCRIPT_PATH)
+	if strings.HasPrefix(script, header) {
+		return script
+	}
+	script = strings.TrimPrefix(script, "#!/bin/bash")
+	script = strings.TrimSpace(script)
+	script = strings.TrimSpace(strings.TrimSuffix(script, "sudo init 0"))
+	delimiter := BUILD_SCRIPT_DELIMITER
+	for i := 1; strings.Contains(script, delimiter); i++ {
+		delimiter = fmt.Sprintf("%v%v__", BUILD_SCRIPT_DELIMITER, i)
+	}
+	lines := []string{
+		"#!/bin/bash",
+		fmt.Sprintf("cat > %v <<'%v'", BUILD_SCRIPT_PATH, delimiter),
+		"#!/bin/bash",
+		script,
+		delimiter,
+		fmt.Sprintf("bash %v", BUILD_SCRIPT_PATH),
+		"status=$?",
+		"if [ $status -eq 0 ]; then",
+		fmt.Sprintf("    echo \"%v %v\" | tee /dev/console", BUILD_RESULT_MARKER, BUILD_RESULT_SUCCESS),
+		"else",
+		fmt.Sprintf("    echo \"%v %v exit status $status\" | tee /dev/console", BUILD_RESULT_MARKER, BUILD_RESULT_FAILURE),
+		"fi",
+		"sync",
+		"sudo init 0",
+		"",
+	}
+	return strings.Join(lines, "\n")
+}
+
+// parseBuildResult looks for the last build result marker in the console
+// output of a builder. A marker line cut short at the end of the output is
+// reported missing, the rest of it may show up in the next fetch.
+func parseBuildResult(console string) error {
+	index := strings.LastIndex(console, BUILD_RESULT_MARKER)
+	if index < 0 {
+		return ErrBuildResultMissing
+	}
+	line := console[index+len(BUILD_RESULT_MARKER):]
+	end := strings.IndexAny(line, "\r\n")
+	if end >= 0 {
+		line = line[:end]
+	}
+	line = strings.TrimSpace(line)
+	if end < 0 && line != BUILD_RESULT_SUCCESS && !strings.HasPrefix(line, BUILD_RESULT_FAILURE) {
+		return ErrBuildResultMissing
+	}
+	switch {
+	case line == BUILD_RESULT_SUCCESS:
+		return nil
+	case strings.HasPrefix(line, BUILD_RESULT_FAILURE):
+		return &BuildScriptFailure{Detail: strings.TrimSpace(strings.TrimPrefix(line, BUILD_RESULT_FAILURE))}
+	default:
+		return fmt.Errorf("unexpected build result '%v' in console output", line)
+	}
+}
@@ -0,0 +1,85 @@
+package autorefresh
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseBuildResult(t *testing.T) {
+	tests := []struct {
+		name    string
+		console string
+		result  string
+	}{
+		{"success", "boot\nAUTOREFRESH-AMI-BUILD-RESULT: SUCCESS\nshutdown\n", ""},
+		{"success at the end", "boot\nAUTOREFRESH-AMI-BUILD-RESULT: SUCCESS", ""},
+		{"success with carriage return", "AUTOREFRESH-AMI-BUILD-RESULT: SUCCESS\r\n", ""},
+		{"failure", "AUTOREFRESH-AMI-BUILD-RESULT: FAILURE exit status 2\n",
+			"user data script failed: exit status 2"},
+		{"last marker wins", "AUTOREFRESH-AMI-BUILD-RESULT: FAILURE exit status 1\n" +
+			"AUTOREFRESH-AMI-BUILD-RESULT: SUCCESS\n", ""},
+		{"missing", "boot\nshutdown\n", ErrBuildResultMissing.Error()},
+		{"empty", "", ErrBuildResultMissing.Error()},
+		{"marker cut short", "boot\nAUTOREFRESH-AMI-BUI", ErrBuildResultMissing.Error()},
+		{"result cut short", "boot\nAUTOREFRESH-AMI-BUILD-RESULT: SUCC", ErrBuildResultMissing.Error()},
+		{"unexpected result", "AUTOREFRESH-AMI-BUILD-RESULT: MAYBE\n",
+			"unexpected build result 'MAYBE' in console output"},
+	}
+	for _, test := range tests {
+		err := parseBuildResult(test.console)
+		message := ""
+		if err != nil {
+			message = err.Error()
+		}
+		if message != test.result {
+			t.Errorf("%v: got %q, expected %q", test.name, message, test.result)
+		}
+	}
+}
+
+func TestParseBuildResultAcrossFetches(t *testing.T) {
+	console := "boot\nAUTOREFRESH-AMI-BUILD-RESULT: SUCCESS\nshutdown\n"
+	for i := range console {
+		err := parseBuildResult(console[:i])
+		if err != nil && err != ErrBuildResultMissing {
+			t.Errorf("Output cut after %v bytes: %v", i, err)
+		}
+	}
+	if err := parseBuildResult(console); err != nil {
+		t.Errorf("Full output: %v", err)
+	}
+}
+
+func TestWrapUserData(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+	}{
+		{"plain", "#!/bin/bash\necho hello\nsudo init 0"},
+		{"without shebang", "echo hello"},
+		{"with the heredoc delimiter", "#!/bin/bash\necho hello\n" + BUILD_SCRIPT_DELIMITER + "\necho world"},
+	}
+	for _, test := range tests {
+		wrapped := wrapUserData(test.script)
+		if again := wrapUserData(wrapped); again != wrapped {
+			t.Errorf("%v: wrapped twice", test.name)
+		}
+		lines := strings.Split(wrapped, "\n")
+		delimiter := strings.TrimSuffix(strings.SplitN(lines[1], "<<'", 2)[1], "'")
+		end := -1
+		for i, line := range lines[2:] {
+			if line == delimiter {
+				end = i + 2
+				break
+			}
+		}
+		body := strings.Join(lines[3:end], "\n")
+		expected := strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(test.script, "#!/bin/bash"), "sudo init 0"))
+		if body != expected {
+			t.Errorf("%v: heredoc holds %q, expected %q", test.name, body, expected)
+		}
+		if strings.Count(wrapped, "sudo init 0") != 1 || !strings.Contains(wrapped, BUILD_RESULT_MARKER) {
+			t.Errorf("%v: unexpected wrapper\n%v", test.name, wrapped)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package autorefresh
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Ec2Client is the subset of the EC2 API used by the autorefresh package.
+// *ec2.EC2 satisfies it, and so does FakeEc2.
+type Ec2Client interface {
+	RunInstances(*ec2.RunInstancesInput) (*ec2.Reservation, error)
+	DescribeInstances(*ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error)
+	DescribeInstanceStatus(*ec2.DescribeInstanceStatusInput) (*ec2.DescribeInstanceStatusOutput, error)
+	CreateTags(*ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error)
+	DeleteTags(*ec2.DeleteTagsInput) (*ec2.DeleteTagsOutput, error)
+	CreateImage(*ec2.CreateImageInput) (*ec2.CreateImageOutput, error)
+	DescribeImages(*ec2.DescribeImagesInput) (*ec2.DescribeImagesOutput, error)
+	DescribeLaunchTemplateVersions(*ec2.DescribeLaunchTemplateVersionsInput) (*ec2.DescribeLaunchTemplateVersionsOutput, error)
+	DeregisterImage(*ec2.DeregisterImageInput) (*ec2.DeregisterImageOutput, error)
+	DeleteSnapshot(*ec2.DeleteSnapshotInput) (*ec2.DeleteSnapshotOutput, error)
+	TerminateInstances(*ec2.TerminateInstancesInput) (*ec2.TerminateInstancesOutput, error)
+	GetConsoleOutput(*ec2.GetConsoleOutputInput) (*ec2.GetConsoleOutputOutput, error)
+}
+
+// S3Client is the subset of the S3 API used to store builder console output.
+type S3Client interface {
+	PutObject(*s3.PutObjectInput) (*s3.PutObjectOutput, error)
+}
+
+// AutoscalingClient is the subset of the Auto Scaling API used to find the
+// launch configurations and groups referencing an AMI.
+type AutoscalingClient interface {
+	DescribeLaunchConfigurations(*autoscaling.DescribeLaunchConfigurationsInput) (*autoscaling.DescribeLaunchConfigurationsOutput, error)
+	DescribeAutoScalingGroups(*autoscaling.DescribeAutoScalingGroupsInput) (*autoscaling.DescribeAutoScalingGroupsOutput, error)
+}
+
+// Ec2ClientFactory returns the client used by an account for the given region.
+type Ec2ClientFactory func(account *Account, region string) Ec2Client
+
+// PAGE_SIZE is the MaxResults used for filter based Describe* calls.
+const PAGE_SIZE = 1000
+
+// Launch template versions, launch configurations and Auto Scaling groups are
+// returned in smaller pages at most.
+const LAUNCH_TEMPLATE_PAGE_SIZE = 200
+const LAUNCH_CONFIGURATION_PAGE_SIZE = 100
+const AUTOSCALING_GROUP_PAGE_SIZE = 100
+
+// describeAllImages follows NextToken until every matching image is returned.
+func describeAllImages(connection Ec2Client, input *ec2.DescribeImagesInput) ([]*ec2.Image, error) {
+	images := make([]*ec2.Image, 0)
+	if len(input.ImageIds) == 0 && input.MaxResults == nil {
+		input.MaxResults = aws.Int64(PAGE_SIZE)
+	}
+	for {
+		resp, err := connection.DescribeImages(input)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, resp.Images...)
+		if aws.StringValue(resp.NextToken) == "" {
+			return images, nil
+		}
+		input.NextToken = resp.NextToken
+	}
+}
+
+// describeAllInstances follows NextToken until every matching instance is
+// returned.
+func describeAllInstances(connection Ec2Client, input *ec2.DescribeInstancesInput) ([]*ec2.Instance, error) {
+	instances := make([]*ec2.Instance, 0)
+	if len(input.InstanceIds) == 0 && input.MaxResults == nil {
+		input.MaxResults = aws.Int64(PAGE_SIZE)
+	}
+	for {
+		resp, err := connection.DescribeInstances(input)
+		if err != nil {
+			return nil, err
+		}
+		for _, reservation := range resp.Reservations {
+			instances = append(instances, reservation.Instances...)
+		}
+		if aws.StringValue(resp.NextToken) == "" {
+			return instances, nil
+		}
+		input.NextToken = resp.NextToken
+	}
+}
+
+// S3ClientFactory returns the S3 client used by an account for the given region.
+type S3ClientFactory func(account *Account, region string) S3Client
+
+// AutoscalingClientFactory returns the Auto Scaling client used by an account
+// for the given region.
+type AutoscalingClientFactory func(account *Account, region string) AutoscalingClient
+
+// describeAllLaunchTemplateVersions follows NextToken until every matching
+// launch template version is returned. MaxResults cannot be combined with
+// version numbers, so it is only set when no Versions are given.
+func describeAllLaunchTemplateVersions(connection Ec2Client,
+	input *ec2.DescribeLaunchTemplateVersionsInput) ([]*ec2.LaunchTemplateVersion, error) {
+	versions := make([]*ec2.LaunchTemplateVersion, 0)
+	if input.MaxResults == nil && len(input.Versions) == 0 {
+		input.MaxResults = aws.Int64(LAUNCH_TEMPLATE_PAGE_SIZE)
+	}
+	for {
+		resp, err := connection.DescribeLaunchTemplateVersions(input)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, resp.LaunchTemplateVersions...)
+		if aws.StringValue(resp.NextToken) == "" {
+			return versions, nil
+		}
+		input.NextToken = resp.NextToken
+	}
+}
+
+// describeAllLaunchConfigurations follows NextToken until every launch
+// configuration is returned.
+func describeAllLaunchConfigurations(connection AutoscalingClient) ([]*autoscaling.LaunchConfiguration, error) {
+	configurations := make([]*autoscaling.LaunchConfiguration, 0)
+	input := new(autoscaling.DescribeLaunchConfigurationsInput)
+	input.MaxRecords = aws.Int64(LAUNCH_CONFIGURATION_PAGE_SIZE)
+	for {
+		resp, err := connection.DescribeLaunchConfigurations(input)
+		if err != nil {
+			return nil, err
+		}
+		configurations = append(configurations, resp.LaunchConfigurations...)
+		if aws.StringValue(resp.NextToken) == "" {
+			return configurations, nil
+		}
+		input.NextToken = resp.NextToken
+	}
+}
+
+// describeAllAutoScalingGroups follows NextToken until every Auto Scaling
+// group is returned.
+func describeAllAutoScalingGroups(connection AutoscalingClient) ([]*autoscaling.Group, error) {
+	groups := make([]*autoscaling.Group, 0)
+	input := new(autoscaling.DescribeAutoScalingGroupsInput)
+	input.MaxRecords = aws.Int64(AUTOSCALING_GROUP_PAGE_SIZE)
+	for {
+		resp, err := connection.DescribeAutoScalingGroups(input)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, resp.AutoScalingGroups...)
+		if aws.StringValue(resp.NextToken) == "" {
+			return groups, nil
+		}
+		input.NextToken = resp.NextToken
+	}
+}
@@ -0,0 +1,87 @@
+package autorefresh
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"testing"
+	"time"
+)
+
+const TEST_PAGED_RESOURCES = 5
+
+func TestFindAmiPaginated(t *testing.T) {
+	fake := NewFakeEc2("111111111111")
+	fake.PageSize = 1
+	tags := map[string]string{TAG_MAINTAINED_BY: "AutoRefreshAmi"}
+	created := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < TEST_PAGED_RESOURCES; i++ {
+		fake.AddImage(&ec2.Image{
+			CreationDate: aws.String(created.Add(time.Duration(i) * time.Hour).Format(time.RFC3339)),
+			Tags:         testTags(tags),
+		})
+	}
+	fake.AddImage(&ec2.Image{CreationDate: aws.String(created.Format(time.RFC3339))})
+
+	ami := AutoAmi{Connection: fake, Region: "us-east-1", Tags: tags}
+	images, err := ami.findAmi(fake.OwnerId)
+	if err != nil {
+		t.Fatalf("findAmi failed: %v", err)
+	}
+	if len(images) != TEST_PAGED_RESOURCES {
+		t.Fatalf("findAmi returned %v images, expected %v", len(images), TEST_PAGED_RESOURCES)
+	}
+	for i := 1; i < len(images); i++ {
+		if images[i-1].CreationDate < images[i].CreationDate {
+			t.Errorf("Images not sorted newest first: %v before %v", images[i-1].CreationDate, images[i].CreationDate)
+		}
+	}
+	if calls := fake.Calls("DescribeImages"); calls != TEST_PAGED_RESOURCES {
+		t.Errorf("DescribeImages called %v times, expected one call per page", calls)
+	}
+}
+
+func TestFindInstancesPaginated(t *testing.T) {
+	fake := NewFakeEc2("111111111111")
+	fake.PageSize = 1
+	config := LaunchConfig{
+		Source: Source{AmiId: "ami-source", Region: "us-east-1"},
+		Tags:   map[string]string{TAG_MAINTAINED_BY: "AutoRefreshAmi"},
+	}
+	for i := 0; i < TEST_PAGED_RESOURCES; i++ {
+		fake.AddInstance(&ec2.Instance{Tags: testTags(config.Tags)})
+	}
+	fake.AddInstance(&ec2.Instance{})
+
+	account := Account{Name: "test", OwnerId: fake.OwnerId, ClientFactory: fake.Factory()}
+	instances, err := account.FindInstances(&config)
+	if err != nil {
+		t.Fatalf("FindInstances failed: %v", err)
+	}
+	if len(*instances) != TEST_PAGED_RESOURCES {
+		t.Fatalf("FindInstances returned %v instances, expected %v", len(*instances), TEST_PAGED_RESOURCES)
+	}
+	seen := make(map[string]bool)
+	for _, instance := range *instances {
+		if seen[instance.Id] {
+			t.Errorf("Instance %v returned twice", instance.Id)
+		}
+		seen[instance.Id] = true
+	}
+}
+
+func TestDescribeInvalidNextToken(t *testing.T) {
+	fake := NewFakeEc2("111111111111")
+	fake.AddImage(&ec2.Image{})
+	fake.AddInstance(&ec2.Instance{})
+
+	imageInput := new(ec2.DescribeImagesInput)
+	imageInput.NextToken = aws.String("bogus")
+	if _, err := describeAllImages(fake, imageInput); err == nil {
+		t.Errorf("describeAllImages accepted an invalid NextToken")
+	}
+	instanceInput := new(ec2.DescribeInstancesInput)
+	instanceInput.NextToken = aws.String("bogus")
+	if _, err := describeAllInstances(fake, instanceInput); err == nil {
+		t.Errorf("describeAllInstances accepted an invalid NextToken")
+	}
+}
@@ -1,29 +1,48 @@
 package autorefresh
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/robfig/cron"
+	"gopkg.in/yaml.v2"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
+// ConfigStorage holds every config entry loaded by ProcessDirectory. Unknown
+// config types and fields are errors, unless Lenient is set, in which case
+// they are logged and ignored.
 type ConfigStorage struct {
+	Lenient      bool
 	sources      []*Source
 	accounts     map[string]*Account
 	projects     map[string]*Project
 	userdatas    map[string]*UserData
 	GoWait       sync.WaitGroup
 	ConfigErrors int
+	errors       ErrorList
+	warnings     ErrorList
 	logFields    map[string]interface{}
+	origin       configOrigin
+	lines        configLines
+	content      []byte
+	duplicates   []configDuplicate
 }
 
 type UserData struct {
-	Name string
-	Bash string
+	Name   string
+	Bash   string
+	origin configOrigin
 }
 
 func (self *UserData) validateAndSetDefaults() error {
@@ -41,12 +60,7 @@ func (self *UserData) validateAndSetDefaults() error {
 		message := fmt.Sprintf("Mandatory fields missing in UserData: %v", strings.Join(missingFields, ", "))
 		return errors.New(message)
 	}
-	if !strings.HasPrefix(self.Bash, "#!/bin/bash\n") {
-		self.Bash = fmt.Sprintf("%v\n%v", "#!/bin/bash\n", self.Bash)
-	}
-	if !strings.HasSuffix(self.Bash, "\nsudo init 0\n") {
-		self.Bash = fmt.Sprintf("%v\n%v", self.Bash, "\nsudo init 0\n")
-	}
+	self.Bash = wrapUserData(self.Bash)
 	return nil
 }
 
@@ -58,6 +72,7 @@ type Source struct {
 	Region       string
 	Type         string
 	Version      string
+	origin       configOrigin
 }
 
 func (self *Source) Copy() Source {
@@ -106,20 +121,32 @@ type Project struct {
 	Name           string
 	InstanceType   string
 	Cron           string
+	PruneCron      string
 	RetentionCount uint
+	Retention      RetentionPolicy
+	KeepSnapshots  bool
 	SourceFilter   Source
 	UserData       string
 	Account        string
 	EbsVolumes     []EbsVolume
 	Tags           map[string]string
+	BuildTimeout   string
+	AmiTimeout     string
+	ConsoleOutput  ConsoleOutputConfig
+	buildTimeout   time.Duration
+	amiTimeout     time.Duration
+	origin         configOrigin
 }
 
 func (self *Project) validateAndSetDefaults() error {
 	self.Name = strings.TrimSpace(self.Name)
 	self.InstanceType = strings.TrimSpace(self.InstanceType)
 	self.Cron = strings.TrimSpace(self.Cron)
+	self.PruneCron = strings.TrimSpace(self.PruneCron)
 	self.UserData = strings.TrimSpace(self.UserData)
 	self.Account = strings.TrimSpace(self.Account)
+	self.BuildTimeout = strings.TrimSpace(self.BuildTimeout)
+	self.AmiTimeout = strings.TrimSpace(self.AmiTimeout)
 	if self.Tags == nil {
 		self.Tags = make(map[string]string)
 	}
@@ -127,14 +154,18 @@ func (self *Project) validateAndSetDefaults() error {
 		self.InstanceType = "t2.nano"
 		log.Infof("InstanceType not configured for Project '%v'. Using default as %v", self.Name, self.InstanceType)
 	}
-	if self.RetentionCount == 0 {
-		self.RetentionCount = 7
-		log.Infof("RetentionCount not configured or configured as '0', for Project '%v'. Using default as %v", self.Name, self.RetentionCount)
-	}
-	if self.Cron == "" {
-		log.Warningf("No cron defined for project '%v', autorefresh engine will RUN ONCE and exit", self.Name)
+	if !self.Retention.isEmpty() {
+		if self.RetentionCount != 0 {
+			return fmt.Errorf("RetentionCount and Retention are exclusive in Project '%v'", self.Name)
+		}
+	} else {
+		if self.RetentionCount == 0 {
+			self.RetentionCount = 7
+			log.Infof("RetentionCount not configured or configured as '0', for Project '%v'. Using default as %v", self.Name, self.RetentionCount)
+		}
+		self.Retention.KeepLast = self.RetentionCount
 	}
-	self.Tags["__Maintained_By__"] = "AutoRefreshAmi"
+	self.Tags[TAG_MAINTAINED_BY] = "AutoRefreshAmi"
 	missingFields := make([]string, 0)
 	if self.Name == "" {
 		missingFields = append(missingFields, "Name")
@@ -149,83 +180,509 @@ func (self *Project) validateAndSetDefaults() error {
 		message := fmt.Sprintf("Mandatory fields missing in Project: %v", strings.Join(missingFields, ", "))
 		return errors.New(message)
 	}
+	if err := self.ConsoleOutput.validateAndSetDefaults(); err != nil {
+		return err
+	}
+	if err := self.Retention.validateAndSetDefaults(); err != nil {
+		return fmt.Errorf("%v in Project '%v'", err, self.Name)
+	}
+	if self.Cron != "" {
+		if _, err := cron.Parse(self.Cron); err != nil {
+			return fmt.Errorf("Invalid Cron in Project '%v': %v", self.Name, err)
+		}
+	}
+	if self.PruneCron != "" {
+		if _, err := cron.Parse(self.PruneCron); err != nil {
+			return fmt.Errorf("Invalid PruneCron in Project '%v': %v", self.Name, err)
+		}
+		// Without Cron the engine runs once and exits, it never prunes on schedule
+		if self.Cron == "" {
+			return fmt.Errorf("PruneCron of Project '%v' requires Cron", self.Name)
+		}
+	}
+	// Builds and AMI creation are not bounded unless a timeout is configured
+	var err error
+	if self.BuildTimeout != "" {
+		if self.buildTimeout, err = parseTimeout(self.BuildTimeout); err != nil {
+			return fmt.Errorf("Invalid BuildTimeout in Project '%v': %v", self.Name, err)
+		}
+	}
+	if self.AmiTimeout != "" {
+		if self.amiTimeout, err = parseTimeout(self.AmiTimeout); err != nil {
+			return fmt.Errorf("Invalid AmiTimeout in Project '%v': %v", self.Name, err)
+		}
+	}
 	return nil
 }
 
+func parseTimeout(value string) (time.Duration, error) {
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if timeout <= 0 {
+		return 0, fmt.Errorf("timeout must be positive, found '%v'", value)
+	}
+	return timeout, nil
+}
+
 func (self *ConfigStorage) resetLogFields() {
 	self.logFields = make(map[string]interface{})
 }
 
-func (self *ConfigStorage) check(e error, errorType string) {
-	if errorType != "" {
-		self.logFields["Type"] = errorType
-	}
-	if e != nil {
-		log.WithFields(self.logFields).Panic(e)
+func (self *ConfigStorage) wrapError(op string, err error) error {
+	e := newError(ConfigError, op, err)
+	if path, ok := self.logFields["ConfigFile"].(string); ok && e.File == "" {
+		e.File = path
+		if path == self.origin.File {
+			e.Line = self.origin.Line
+		}
 	}
+	return e
 }
 
-func (self *ConfigStorage) recoverPanic() {
-	err := recover()
-	if err != nil {
-		self.ConfigErrors++
-		log.Info("Recovering from config errors, continuing...")
-	}
+func (self *ConfigStorage) recordError(op string, err error) {
+	err = self.wrapError(op, err)
+	self.ConfigErrors++
+	self.errors = append(self.errors, err)
+	self.logFields["Type"] = op
+	log.WithFields(self.errorLogFields(err)).Error(err)
 }
 
-func (self *ConfigStorage) panicIfErrorsFound() {
-	if self.ConfigErrors > 0 {
-		self.resetLogFields()
-		self.logFields["Type"] = "Syntax Errors"
-		self.logFields["ErrorCount"] = self.ConfigErrors
-		log.WithFields(self.logFields).Panic("Config validation failed, exiting...")
+// recordErrorAt records err against the config entry defined at origin.
+func (self *ConfigStorage) recordErrorAt(op string, origin configOrigin, err error) {
+	self.resetLogFields()
+	self.logFields["ConfigFile"] = origin.File
+	if origin.Line > 0 {
+		self.logFields["ConfigLine"] = origin.Line
 	}
+	self.origin = origin
+	self.recordError(op, err)
 }
 
-func (self *ConfigStorage) addSource(data *Source) {
-	err := data.validateAndSetDefaults()
-	self.check(err, "Data Validation")
+func (self *ConfigStorage) addSource(data *Source) error {
+	if err := data.validateAndSetDefaults(); err != nil {
+		return err
+	}
+	data.origin = self.origin
+	for _, existing := range self.sources {
+		if existing.AmiId == data.AmiId {
+			first, second := *existing, *data
+			first.origin, second.origin = configOrigin{}, configOrigin{}
+			self.addDuplicate("Source", data.AmiId, existing.origin, data.origin, reflect.DeepEqual(first, second))
+			return nil
+		}
+	}
 	self.sources = append(self.sources, data)
+	return nil
 }
 
-func (self *ConfigStorage) addAccount(data *Account) {
-	err := data.validateAndSetDefaults()
-	self.check(err, "Data Validation")
+func (self *ConfigStorage) addAccount(data *Account) error {
+	if err := data.validateAndSetDefaults(); err != nil {
+		return err
+	}
+	data.origin = self.origin
 	if self.accounts == nil {
 		self.accounts = make(map[string]*Account)
 	}
+	if existing, ok := self.accounts[data.Name]; ok {
+		first, second := *existing, *data
+		first.origin, second.origin = configOrigin{}, configOrigin{}
+		self.addDuplicate("Account", data.Name, existing.origin, data.origin, reflect.DeepEqual(first, second))
+		return nil
+	}
 	self.accounts[data.Name] = data
+	return nil
 }
 
-func (self *ConfigStorage) addProject(data *Project) {
-	err := data.validateAndSetDefaults()
-	self.check(err, "Data Validation")
+func (self *ConfigStorage) addProject(data *Project) error {
+	if err := data.validateAndSetDefaults(); err != nil {
+		return err
+	}
+	data.origin = self.origin
+	if data.Cron == "" {
+		err := fmt.Errorf("No cron defined for project '%v', autorefresh engine will RUN ONCE and exit", data.Name)
+		self.recordWarning("Schedule", err)
+	}
 	if self.projects == nil {
 		self.projects = make(map[string]*Project)
 	}
+	if existing, ok := self.projects[data.Name]; ok {
+		first, second := *existing, *data
+		first.origin, second.origin = configOrigin{}, configOrigin{}
+		self.addDuplicate("Project", data.Name, existing.origin, data.origin, reflect.DeepEqual(first, second))
+		return nil
+	}
 	self.projects[data.Name] = data
+	return nil
 }
 
-func (self *ConfigStorage) addUserData(data *UserData) {
-	err := data.validateAndSetDefaults()
-	self.check(err, "Data Validation")
+func (self *ConfigStorage) addUserData(data *UserData) error {
+	if err := data.validateAndSetDefaults(); err != nil {
+		return err
+	}
+	data.origin = self.origin
 	if self.userdatas == nil {
 		self.userdatas = make(map[string]*UserData)
 	}
+	if existing, ok := self.userdatas[data.Name]; ok {
+		first, second := *existing, *data
+		first.origin, second.origin = configOrigin{}, configOrigin{}
+		self.addDuplicate("UserData", data.Name, existing.origin, data.origin, reflect.DeepEqual(first, second))
+		return nil
+	}
 	self.userdatas[data.Name] = data
+	return nil
 }
 
-func (self *ConfigStorage) typeConversion(source interface{}, dest interface{}) {
+func (self *ConfigStorage) recordWarning(op string, err error) {
+	err = self.wrapError(op, err)
+	if e, ok := err.(*Error); ok {
+		e.Kind = ConfigWarning
+	}
+	self.warnings = append(self.warnings, err)
+	self.logFields["Type"] = op
+	log.WithFields(self.errorLogFields(err)).Warning(err)
+}
+
+// errorLogFields returns the log fields of the current entry, pointing at the
+// line of err when it is located more precisely.
+func (self *ConfigStorage) errorLogFields(err error) map[string]interface{} {
+	e, ok := err.(*Error)
+	if !ok || e.Line == 0 || e.Line == self.origin.Line {
+		return self.logFields
+	}
+	fields := make(map[string]interface{})
+	for key, value := range self.logFields {
+		fields[key] = value
+	}
+	fields["ConfigLine"] = e.Line
+	return fields
+}
+
+// reportUnknown records err, or only a warning in Lenient mode.
+func (self *ConfigStorage) reportUnknown(op string, err error) {
+	if !self.Lenient {
+		self.recordError(op, err)
+		return
+	}
+	self.recordWarning(op, err)
+}
+
+func (self *ConfigStorage) typeConversion(source interface{}, dest interface{}) error {
+	for _, field := range unknownFields(source, reflect.TypeOf(dest), "") {
+		self.reportUnknown("Unknown Field", self.fieldError("Unknown Field", field,
+			fmt.Errorf("Unknown field '%v'", field)))
+	}
+	source, invalid := stringScalars(source, reflect.TypeOf(dest), "")
+	if len(invalid) > 0 {
+		errs := make(ErrorList, 0)
+		for _, field := range invalid {
+			errs = append(errs, self.fieldError("Data Validation", field,
+				fmt.Errorf("Field '%v' expects a string, quote its value", field)))
+		}
+		if len(errs) == 1 {
+			return errs[0]
+		}
+		return errs
+	}
 	b, _ := json.Marshal(source)
-	err := json.Unmarshal(b, dest)
-	self.check(err, "DataType Conversion")
+	return json.Unmarshal(b, dest)
+}
+
+// fieldError locates err at the line setting field in the current entry.
+func (self *ConfigStorage) fieldError(op string, field string, err error) *Error {
+	e := newError(ConfigError, op, err)
+	e.File = self.origin.File
+	e.Line = fieldLine(self.content, self.origin.Line, field)
+	return e
+}
+
+// stringScalars returns value with the YAML scalars read into string fields
+// of type t replaced by their text, and the path of every other number, bool
+// or date found where t expects a string.
+func stringScalars(value interface{}, t reflect.Type, path string) (interface{}, []string) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	invalid := make([]string, 0)
+	switch v := value.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{})
+		for key, item := range v {
+			result[key] = item
+			var itemType reflect.Type
+			switch t.Kind() {
+			case reflect.Struct:
+				if field, ok := jsonField(t, key); ok {
+					itemType = field.Type
+				}
+			case reflect.Map:
+				itemType = t.Elem()
+			}
+			if itemType == nil {
+				continue
+			}
+			converted, found := stringScalars(item, itemType, joinFieldPath(path, key))
+			result[key] = converted
+			invalid = append(invalid, found...)
+		}
+		sort.Strings(invalid)
+		return result, invalid
+	case []interface{}:
+		if t.Kind() != reflect.Slice && t.Kind() != reflect.Array {
+			return v, invalid
+		}
+		result := make([]interface{}, 0)
+		for index, item := range v {
+			converted, found := stringScalars(item, t.Elem(), fmt.Sprintf("%v[%v]", path, index))
+			result = append(result, converted)
+			invalid = append(invalid, found...)
+		}
+		return result, invalid
+	case yamlScalar:
+		if t.Kind() == reflect.String {
+			return v.Text, invalid
+		}
+		return v.Value, invalid
+	case bool, float64, int, int64, time.Time:
+		if t.Kind() == reflect.String {
+			invalid = append(invalid, path)
+		}
+	}
+	return value, invalid
 }
 
-func (self *ConfigStorage) parseFullJson(jsonByte *[]byte) error {
+// unknownFields returns the path of every key of value that encoding/json
+// would ignore when decoding it into a value of type t.
+func unknownFields(value interface{}, t reflect.Type, path string) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	unknown := make([]string, 0)
+	switch v := value.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			switch t.Kind() {
+			case reflect.Struct:
+				field, ok := jsonField(t, key)
+				if !ok {
+					unknown = append(unknown, joinFieldPath(path, key))
+					continue
+				}
+				unknown = append(unknown, unknownFields(v[key], field.Type, joinFieldPath(path, key))...)
+			case reflect.Map:
+				unknown = append(unknown, unknownFields(v[key], t.Elem(), joinFieldPath(path, key))...)
+			}
+		}
+	case []interface{}:
+		if t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+			for index, item := range v {
+				unknown = append(unknown, unknownFields(item, t.Elem(), fmt.Sprintf("%v[%v]", path, index))...)
+			}
+		}
+	}
+	return unknown
+}
+
+// jsonField finds the struct field encoding/json decodes key into: the
+// exported field named by its json tag or its name, compared case
+// insensitively.
+func jsonField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := field.Name
+		if tag := strings.Split(field.Tag.Get("json"), ",")[0]; tag == "-" {
+			continue
+		} else if tag != "" {
+			name = tag
+		}
+		if strings.EqualFold(name, key) {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func joinFieldPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// CONFIG_FORMATS maps the config file extensions read by ProcessDirectory to
+// their decoders. Every format follows the JSON layout: a document is one
+// {"<ConfigType>": {...}} object or a list of them.
+var CONFIG_FORMATS map[string]func([]byte) (interface{}, error) = map[string]func([]byte) (interface{}, error){
+	".json": decodeJson,
+	".yaml": decodeYaml,
+	".yml":  decodeYaml,
+	".toml": decodeToml,
+}
+
+func decodeJson(data []byte) (interface{}, error) {
 	var jsonInterface interface{}
-	err := json.Unmarshal(*jsonByte, &jsonInterface)
-	self.check(err, "Json Parsing")
-	switch v := jsonInterface.(type) {
+	err := json.Unmarshal(data, &jsonInterface)
+	return jsonInterface, err
+}
+
+// decodeYaml reads every document of a YAML stream. Documents separated by
+// "---" are read as the items of a single list.
+func decodeYaml(data []byte) (interface{}, error) {
+	documents := make([]interface{}, 0)
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var document yamlValue
+		err := decoder.Decode(&document)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch v := normalizeConfig(document).(type) {
+		case nil:
+			continue
+		case []interface{}:
+			documents = append(documents, v...)
+		default:
+			documents = append(documents, v)
+		}
+	}
+	if len(documents) == 1 {
+		return documents[0], nil
+	}
+	return documents, nil
+}
+
+// yamlValue decodes any YAML node. Keys are read as text, and scalars which
+// do not resolve to strings, such as 16.10 or y, are kept as a yamlScalar so
+// that string fields still get their text.
+type yamlValue struct {
+	value interface{}
+}
+
+func (self *yamlValue) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value interface{}
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	switch value.(type) {
+	case map[interface{}]interface{}:
+		mapping := make(map[string]yamlValue)
+		if err := unmarshal(&mapping); err != nil {
+			return err
+		}
+		self.value = mapping
+	case []interface{}:
+		sequence := make([]yamlValue, 0)
+		if err := unmarshal(&sequence); err != nil {
+			return err
+		}
+		self.value = sequence
+	case string, nil:
+		self.value = value
+	default:
+		var text string
+		if err := unmarshal(&text); err != nil {
+			return err
+		}
+		self.value = yamlScalar{Value: value, Text: text}
+	}
+	return nil
+}
+
+// yamlScalar is a YAML scalar decoded as a number, bool or date, along with
+// its text.
+type yamlScalar struct {
+	Value interface{}
+	Text  string
+}
+
+func (self yamlScalar) MarshalJSON() ([]byte, error) {
+	return json.Marshal(self.Value)
+}
+
+func (self yamlScalar) String() string {
+	return self.Text
+}
+
+// decodeToml reads a TOML document. TOML has no top level arrays, so lists
+// are written as arrays of tables, e.g. [[Source]].
+func decodeToml(data []byte) (interface{}, error) {
+	tomlInterface := make(map[string]interface{})
+	if _, err := toml.Decode(string(data), &tomlInterface); err != nil {
+		return nil, err
+	}
+	return normalizeConfig(tomlInterface), nil
+}
+
+// normalizeConfig converts the maps and lists produced by the YAML and TOML
+// decoders into the map[string]interface{} and []interface{} values produced
+// by encoding/json.
+func normalizeConfig(value interface{}) interface{} {
+	switch v := value.(type) {
+	case yamlValue:
+		return normalizeConfig(v.value)
+	case map[string]yamlValue:
+		result := make(map[string]interface{})
+		for key, item := range v {
+			result[key] = normalizeConfig(item)
+		}
+		return result
+	case []yamlValue:
+		result := make([]interface{}, 0)
+		for _, item := range v {
+			result = append(result, normalizeConfig(item))
+		}
+		return result
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{})
+		for key, item := range v {
+			result[fmt.Sprint(key)] = normalizeConfig(item)
+		}
+		return result
+	case map[string]interface{}:
+		result := make(map[string]interface{})
+		for key, item := range v {
+			result[key] = normalizeConfig(item)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, 0)
+		for _, item := range v {
+			result = append(result, normalizeConfig(item))
+		}
+		return result
+	case []map[string]interface{}:
+		result := make([]interface{}, 0)
+		for _, item := range v {
+			result = append(result, normalizeConfig(item))
+		}
+		return result
+	default:
+		return v
+	}
+}
+
+func (self *ConfigStorage) parseFull(format string, data *[]byte) {
+	self.lines = CONFIG_LINE_FINDERS[format](*data)
+	self.content = *data
+	configInterface, err := CONFIG_FORMATS[format](*data)
+	if err != nil {
+		self.recordError(fmt.Sprintf("%v Parsing", strings.ToUpper(strings.TrimPrefix(format, "."))), err)
+		return
+	}
+	switch v := configInterface.(type) {
 	case []interface{}:
 		for _, configInterface := range v {
 			self.parseConfig(configInterface)
@@ -233,69 +690,152 @@ func (self *ConfigStorage) parseFullJson(jsonByte *[]byte) error {
 	default:
 		self.parseConfig(v)
 	}
-	return nil
 }
 
-func (self *ConfigStorage) parseConfig(jsonInterface interface{}) error {
+func (self *ConfigStorage) parseConfig(jsonInterface interface{}) {
 	switch v := jsonInterface.(type) {
 	case map[string]interface{}:
 		for configType, jsonInterface := range v {
-			self.logFields[configType] = jsonInterface
-			switch strings.ToLower(configType) {
-			case "source":
-				foundSource := Source{}
-				self.typeConversion(jsonInterface, &foundSource)
-				self.addSource(&foundSource)
-			case "account":
-				foundAccount := Account{}
-				self.typeConversion(jsonInterface, &foundAccount)
-				self.addAccount(&foundAccount)
-			case "project":
-				foundProject := Project{}
-				self.typeConversion(jsonInterface, &foundProject)
-				self.addProject(&foundProject)
-			case "userdata":
-				foundUserData := UserData{}
-				self.typeConversion(jsonInterface, &foundUserData)
-				self.addUserData(&foundUserData)
-			default:
-				fmt.Printf("ConfigType %v not defined: %v\n", configType, jsonInterface)
+			configList, ok := jsonInterface.([]interface{})
+			if !ok {
+				configList = []interface{}{jsonInterface}
+			}
+			lines := self.lines.next(configType)
+			for index, jsonInterface := range configList {
+				self.setLine(lines, index)
+				self.logFields[configType] = jsonInterface
+				if err := self.addConfig(configType, jsonInterface); err != nil {
+					self.recordError("Data Validation", err)
+				}
+				delete(self.logFields, configType)
 			}
-			delete(self.logFields, configType)
+			self.setLine(nil, 0)
 		}
 	default:
-		fmt.Printf("Invalid config. %+v\n", v)
+		self.reportUnknown("Invalid Config", fmt.Errorf("Expected a map of config types, found: %v", v))
+	}
+}
+
+// setLine points the current origin at the line of entry index, or at the
+// last known line when entries were not told apart.
+func (self *ConfigStorage) setLine(lines []int, index int) {
+	self.origin.Line = 0
+	delete(self.logFields, "ConfigLine")
+	if len(lines) == 0 {
+		return
+	}
+	if index >= len(lines) {
+		index = len(lines) - 1
+	}
+	self.origin.Line = lines[index]
+	self.logFields["ConfigLine"] = self.origin.Line
+}
+
+func (self *ConfigStorage) addConfig(configType string, jsonInterface interface{}) error {
+	switch strings.ToLower(configType) {
+	case "source":
+		foundSource := Source{}
+		if err := self.typeConversion(jsonInterface, &foundSource); err != nil {
+			return err
+		}
+		return self.addSource(&foundSource)
+	case "account":
+		foundAccount := Account{}
+		if err := self.typeConversion(jsonInterface, &foundAccount); err != nil {
+			return err
+		}
+		return self.addAccount(&foundAccount)
+	case "project":
+		foundProject := Project{}
+		if err := self.typeConversion(jsonInterface, &foundProject); err != nil {
+			return err
+		}
+		return self.addProject(&foundProject)
+	case "userdata":
+		foundUserData := UserData{}
+		if err := self.typeConversion(jsonInterface, &foundUserData); err != nil {
+			return err
+		}
+		return self.addUserData(&foundUserData)
+	default:
+		self.reportUnknown("Unknown Config Type", fmt.Errorf("Unknown config type '%v'", configType))
 	}
 	return nil
 }
 
 func (self *ConfigStorage) visit(path string, f os.FileInfo, err error) error {
-	defer self.recoverPanic()
 	self.resetLogFields()
 	self.logFields["ConfigFile"] = path
+	self.origin = configOrigin{File: path}
+	if err != nil {
+		self.recordError("Directory Search", err)
+		return nil
+	}
 	if f.IsDir() {
 		return nil
 	}
-	if !strings.HasSuffix(strings.ToLower(path), ".json") {
-		log.WithFields(self.logFields).Debug("Ignoring non-json file in the config directory")
+	format := strings.ToLower(filepath.Ext(path))
+	if _, ok := CONFIG_FORMATS[format]; !ok {
+		log.WithFields(self.logFields).Debug("Ignoring unsupported file in the config directory")
+		return nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		self.recordError("File Reading", err)
 		return nil
 	}
-	jsonByte, err := ioutil.ReadFile(path)
-	self.check(err, "File Reading")
-	if strings.TrimSpace(string(jsonByte)) == "" {
-		log.WithFields(self.logFields).Info("Ignoring blank json file")
+	if strings.TrimSpace(string(data)) == "" {
+		log.WithFields(self.logFields).Info("Ignoring blank config file")
 		return nil
 	}
-	err = self.parseFullJson(&jsonByte)
-	self.check(err, "Json Parsing")
-	return err
+	self.parseFull(format, &data)
+	return nil
 }
 
+// ProcessDirectory loads every config file found under path. Errors do not
+// stop the walk; all of them are returned together as a ConfigError.
 func (self *ConfigStorage) ProcessDirectory(path string) error {
 	self.resetLogFields()
 	self.logFields["ConfigDirectory"] = path
-	err := filepath.Walk(path, self.visit)
-	self.check(err, "Directory Search")
-	self.panicIfErrorsFound()
-	return err
+	filepath.Walk(path, self.visit)
+	self.resetLogFields()
+	self.origin = configOrigin{}
+	self.validateReferences()
+	self.validateRegions()
+	if self.ConfigErrors > 0 {
+		self.resetLogFields()
+		self.logFields["Type"] = "Syntax Errors"
+		self.logFields["ErrorCount"] = self.ConfigErrors
+		log.WithFields(self.logFields).Error("Config validation failed")
+		return &Error{Kind: ConfigError, Op: "ProcessDirectory", File: path, Err: self.errors}
+	}
+	return nil
+}
+
+// validateRegions checks every source matched by a project against the
+// partition of the project account, so a wrong region fails at load time
+// rather than at RunInstances.
+func (self *ConfigStorage) validateRegions() {
+	for _, project := range self.projects {
+		account, ok := self.accounts[project.Account]
+		if !ok {
+			continue
+		}
+		for _, source := range project.SourceFilter.findSources(&self.sources) {
+			if err := account.ValidateRegion(source.Region); err != nil {
+				err = fmt.Errorf("Project '%v', source %v: %v", project.Name, source.AmiId, err)
+				self.recordErrorAt("Region Validation", project.origin, err)
+			}
+		}
+	}
+}
+
+// Errors returns every error recorded while processing config files.
+func (self *ConfigStorage) Errors() []error {
+	return self.errors
+}
+
+// Warnings returns the problems that did not fail config processing.
+func (self *ConfigStorage) Warnings() []error {
+	return self.warnings
 }
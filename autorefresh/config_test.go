@@ -0,0 +1,207 @@
+package autorefresh
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestConfig writes files, by name, to a new config directory.
+func writeTestConfig(t *testing.T, files map[string]string) string {
+	directory, err := ioutil.TempDir("", "autorefresh-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(directory, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return directory
+}
+
+func TestProjectTimeouts(t *testing.T) {
+	tests := []struct {
+		buildTimeout string
+		amiTimeout   string
+		build        time.Duration
+		ami          time.Duration
+		valid        bool
+	}{
+		{"", "", 0, 0, true},
+		{"45m", "2h", 45 * time.Minute, 2 * time.Hour, true},
+		{"45", "", 0, 0, false},
+		{"", "-1h", 0, 0, false},
+	}
+	for _, test := range tests {
+		project := Project{Name: "test", UserData: "test", Account: "test",
+			BuildTimeout: test.buildTimeout, AmiTimeout: test.amiTimeout}
+		err := project.validateAndSetDefaults()
+		if (err == nil) != test.valid {
+			t.Errorf("%q/%q: unexpected error %v", test.buildTimeout, test.amiTimeout, err)
+			continue
+		}
+		if test.valid && (project.buildTimeout != test.build || project.amiTimeout != test.ami) {
+			t.Errorf("%q/%q: parsed as %v/%v", test.buildTimeout, test.amiTimeout, project.buildTimeout, project.amiTimeout)
+		}
+	}
+}
+
+func TestConfigFormats(t *testing.T) {
+	directory := writeTestConfig(t, map[string]string{
+		"sources.yaml": `Source:
+  AmiId: ami-yaml
+  Region: us-east-1
+  Version: 16.10
+  OS: y
+---
+- Source:
+    AmiId: ami-list
+    Region: us-east-1
+    Version: 18.04
+- UserData:
+    Name: basic
+    Bash: echo hello
+`,
+		"sources.toml": `[Account]
+Name = "acct"
+OwnerId = "123456789012"
+
+[[Source]]
+AmiId = "ami-toml-1"
+Region = "us-east-1"
+
+[[Source]]
+AmiId = "ami-toml-2"
+Region = "us-west-2"
+Version = "16.10"
+`,
+	})
+	defer os.RemoveAll(directory)
+	cs := ConfigStorage{}
+	if err := cs.ProcessDirectory(directory); err != nil {
+		t.Fatalf("ProcessDirectory failed: %v", err)
+	}
+
+	sources := make(map[string]*Source)
+	for _, source := range cs.sources {
+		sources[source.AmiId] = source
+	}
+	tests := []struct {
+		amiId   string
+		version string
+		os      string
+		file    string
+		line    int
+	}{
+		{"ami-yaml", "16.10", "y", "sources.yaml", 1},
+		{"ami-list", "18.04", "", "sources.yaml", 7},
+		{"ami-toml-1", "", "", "sources.toml", 5},
+		{"ami-toml-2", "16.10", "", "sources.toml", 9},
+	}
+	if len(sources) != len(tests) {
+		t.Errorf("Found %v sources, expected %v", len(sources), len(tests))
+	}
+	for _, test := range tests {
+		source, ok := sources[test.amiId]
+		if !ok {
+			t.Errorf("Source %v not found", test.amiId)
+			continue
+		}
+		if source.Version != test.version || source.OS != test.os {
+			t.Errorf("Source %v: Version %q and OS %q, expected %q and %q", test.amiId, source.Version, source.OS,
+				test.version, test.os)
+		}
+		origin := configOrigin{File: filepath.Join(directory, test.file), Line: test.line}
+		if source.origin != origin {
+			t.Errorf("Source %v defined at %v, expected %v", test.amiId, source.origin, origin)
+		}
+	}
+	if cs.accounts["acct"] == nil || cs.userdatas["basic"] == nil {
+		t.Errorf("Account or UserData missing: %v %v", cs.accounts, cs.userdatas)
+	}
+}
+
+func TestConfigStringScalars(t *testing.T) {
+	tests := []struct {
+		file  string
+		data  string
+		field string
+		line  int
+	}{
+		{"source.json", "{\"Source\": {\n  \"AmiId\": \"ami-1\",\n  \"Version\": 16.10\n}}", "Version", 3},
+		{"source.toml", "[Source]\nAmiId = \"ami-1\"\n\nVersion = 16.10\n", "Version", 4},
+		{"source.toml", "[Source]\nAmiId = \"ami-1\"\nOS = true\n", "OS", 3},
+	}
+	for _, test := range tests {
+		directory := writeTestConfig(t, map[string]string{test.file: test.data})
+		cs := ConfigStorage{}
+		err := cs.ProcessDirectory(directory)
+		os.RemoveAll(directory)
+		if err == nil || len(cs.Errors()) != 1 {
+			t.Errorf("%v: expected one error, got %v", test.file, err)
+			continue
+		}
+		e, ok := cs.Errors()[0].(*Error)
+		if !ok || e.Line != test.line || !strings.Contains(e.Error(), "'"+test.field+"' expects a string") {
+			t.Errorf("%v: unexpected error %v", test.file, cs.Errors()[0])
+		}
+	}
+}
+
+func TestConfigUnknownFields(t *testing.T) {
+	const definitions = `{"Account": {"Name": "a", "OwnerId": "123456789012"}},
+{"UserData": {"Name": "u", "Bash": "echo hello"}},
+{"Source": {"AmiId": "ami-1", "Region": "us-east-1"}},
+`
+	tests := []struct {
+		name    string
+		data    string
+		message string
+		line    int
+	}{
+		{"misspelled field", "[" + definitions + `{"Project": {
+    "Name": "p",
+    "UserData": "u",
+    "Account": "a",
+    "Cron": "@daily",
+    "RetentionCnt": 3
+}}]`, "Unknown field 'RetentionCnt'", 9},
+		{"unknown config type", "[" + definitions + `{"Sorce": {"AmiId": "ami-2"}}]`,
+			"Unknown config type 'Sorce'", 4},
+	}
+	for _, test := range tests {
+		for _, lenient := range []bool{false, true} {
+			directory := writeTestConfig(t, map[string]string{"config.json": test.data})
+			cs := ConfigStorage{Lenient: lenient}
+			err := cs.ProcessDirectory(directory)
+			os.RemoveAll(directory)
+			reported := cs.Errors()
+			if lenient {
+				if err != nil {
+					t.Errorf("%v, lenient: unexpected error %v", test.name, err)
+				}
+				reported = cs.Warnings()
+			} else if err == nil || len(cs.Warnings()) != 0 {
+				t.Errorf("%v, strict: expected an error only, got %v and warnings %v", test.name, err,
+					cs.Warnings())
+			}
+			if len(reported) != 1 {
+				t.Errorf("%v, lenient %v: reported %v", test.name, lenient, reported)
+				continue
+			}
+			kind := ConfigError
+			if lenient {
+				kind = ConfigWarning
+			}
+			e, ok := reported[0].(*Error)
+			if !ok || e.Kind != kind || e.Line != test.line ||
+				!strings.HasPrefix(e.Error(), kind.String()) || !strings.Contains(e.Error(), test.message) {
+				t.Errorf("%v, lenient %v: unexpected report %v", test.name, lenient, reported[0])
+			}
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package autorefresh
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const DEFAULT_CONSOLE_OUTPUT_DIRECTORY = "console-output"
+const DEFAULT_CONSOLE_OUTPUT_TIMEOUT = "10m"
+
+// ConsoleOutputConfig tells where builder console output is kept. Output is
+// written below Directory unless S3Bucket is set. Timeout bounds the wait for
+// the build result to show up in the output once the builder stopped; the
+// project BuildTimeout bounds it as well.
+type ConsoleOutputConfig struct {
+	Directory string
+	S3Bucket  string
+	S3Prefix  string
+	S3Region  string
+	Timeout   string
+	timeout   time.Duration
+}
+
+func (self *ConsoleOutputConfig) validateAndSetDefaults() error {
+	self.Directory = strings.TrimSpace(self.Directory)
+	self.S3Bucket = strings.TrimSpace(self.S3Bucket)
+	self.S3Prefix = strings.Trim(strings.TrimSpace(self.S3Prefix), "/")
+	self.S3Region = strings.TrimSpace(self.S3Region)
+	self.Timeout = strings.TrimSpace(self.Timeout)
+	if self.Directory == "" {
+		self.Directory = DEFAULT_CONSOLE_OUTPUT_DIRECTORY
+	}
+	if self.Timeout == "" {
+		self.Timeout = DEFAULT_CONSOLE_OUTPUT_TIMEOUT
+	}
+	timeout, err := parseTimeout(self.Timeout)
+	if err != nil {
+		return fmt.Errorf("Invalid ConsoleOutput.Timeout: %v", err)
+	}
+	self.timeout = timeout
+	return nil
+}
+
+// ConsoleStore saves console output under a relative name and returns the
+// location it was written to.
+type ConsoleStore interface {
+	Store(name string, output []byte) (string, error)
+}
+
+type LocalConsoleStore struct {
+	Directory string
+}
+
+func (self *LocalConsoleStore) Store(name string, output []byte) (string, error) {
+	location := filepath.Join(self.Directory, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(location), 0755); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(location, output, 0644); err != nil {
+		return "", err
+	}
+	return location, nil
+}
+
+type S3ConsoleStore struct {
+	Bucket     string
+	Prefix     string
+	Connection S3Client
+}
+
+func (self *S3ConsoleStore) Store(name string, output []byte) (string, error) {
+	key := path.Join(self.Prefix, name)
+	input := new(s3.PutObjectInput)
+	input.Bucket = aws.String(self.Bucket)
+	input.Key = aws.String(key)
+	input.Body = bytes.NewReader(output)
+	input.ContentType = aws.String("text/plain")
+	if _, err := self.Connection.PutObject(input); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("s3://%v/%v", self.Bucket, key), nil
+}
+
+var unsafePathCharacters = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// consoleOutputName builds "<project>/<region>/<time>-<instance id>.log".
+func consoleOutputName(project string, region string, instanceId string, when time.Time) string {
+	return path.Join(
+		unsafePathCharacters.ReplaceAllString(project, "_"),
+		region,
+		fmt.Sprintf("%v-%v.log", when.UTC().Format("20060102T150405Z"), instanceId),
+	)
+}
@@ -0,0 +1,150 @@
+package autorefresh
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"os"
+	"strings"
+	"time"
+)
+
+// Values accepted in Account.CredentialSource
+const (
+	CREDENTIALS_DEFAULT     = "default"
+	CREDENTIALS_STATIC      = "static"
+	CREDENTIALS_ENVIRONMENT = "environment"
+	CREDENTIALS_SHARED      = "shared"
+	CREDENTIALS_EC2ROLE     = "ec2role"
+	CREDENTIALS_WEBIDENTITY = "webidentity"
+)
+
+const SESSION_NAME = "autorefresh-ami"
+
+// Assumed role credentials are renewed this long before they expire, so long
+// running builds never see an expired token.
+const ROLE_EXPIRY_WINDOW = 5 * time.Minute
+
+var CREDENTIAL_SOURCES map[string]bool = map[string]bool{
+	CREDENTIALS_DEFAULT:     true,
+	CREDENTIALS_STATIC:      true,
+	CREDENTIALS_ENVIRONMENT: true,
+	CREDENTIALS_SHARED:      true,
+	CREDENTIALS_EC2ROLE:     true,
+	CREDENTIALS_WEBIDENTITY: true,
+}
+
+func (self *Account) validateCredentials() error {
+	self.CredentialSource = strings.ToLower(strings.TrimSpace(self.CredentialSource))
+	self.Profile = strings.TrimSpace(self.Profile)
+	self.CredentialsFile = strings.TrimSpace(self.CredentialsFile)
+	self.WebIdentityRoleArn = strings.TrimSpace(self.WebIdentityRoleArn)
+	self.WebIdentityTokenFile = strings.TrimSpace(self.WebIdentityTokenFile)
+	self.RoleArn = strings.TrimSpace(self.RoleArn)
+	self.ExternalId = strings.TrimSpace(self.ExternalId)
+	self.RoleSessionName = strings.TrimSpace(self.RoleSessionName)
+	if self.RoleArn == "" && (self.ExternalId != "" || self.RoleSessionName != "") {
+		return fmt.Errorf("ExternalId/RoleSessionName configured without RoleArn in Account '%v'", self.Name)
+	}
+	if self.RoleArn != "" && self.RoleSessionName == "" {
+		self.RoleSessionName = SESSION_NAME
+	}
+	hasKeys := self.AccessKeyId != "" || self.SecretAccessKey != ""
+	if self.CredentialSource == "" {
+		if hasKeys {
+			self.CredentialSource = CREDENTIALS_STATIC
+		} else {
+			self.CredentialSource = CREDENTIALS_DEFAULT
+		}
+	}
+	if !CREDENTIAL_SOURCES[self.CredentialSource] {
+		return fmt.Errorf("Invalid CredentialSource '%v' in Account '%v'", self.CredentialSource, self.Name)
+	}
+	if hasKeys && self.CredentialSource != CREDENTIALS_STATIC {
+		return fmt.Errorf("AccessKeyId/SecretAccessKey are only used with CredentialSource '%v' in Account '%v'",
+			CREDENTIALS_STATIC, self.Name)
+	}
+	missingFields := make([]string, 0)
+	switch self.CredentialSource {
+	case CREDENTIALS_STATIC:
+		if self.AccessKeyId == "" {
+			missingFields = append(missingFields, "AccessKeyId")
+		}
+		if self.SecretAccessKey == "" {
+			missingFields = append(missingFields, "SecretAccessKey")
+		}
+	case CREDENTIALS_WEBIDENTITY:
+		if self.WebIdentityRoleArn == "" {
+			self.WebIdentityRoleArn = os.Getenv("AWS_ROLE_ARN")
+		}
+		if self.WebIdentityTokenFile == "" {
+			self.WebIdentityTokenFile = os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+		}
+		if self.WebIdentityRoleArn == "" {
+			missingFields = append(missingFields, "WebIdentityRoleArn")
+		}
+		if self.WebIdentityTokenFile == "" {
+			missingFields = append(missingFields, "WebIdentityTokenFile")
+		}
+	}
+	if len(missingFields) > 0 {
+		return fmt.Errorf("Mandatory fields missing in Account '%v' for CredentialSource '%v': %v",
+			self.Name, self.CredentialSource, strings.Join(missingFields, ", "))
+	}
+	return nil
+}
+
+// newSession returns a session for region. With RoleArn set the session uses
+// credentials of the assumed role, obtained with the base credentials.
+func (self *Account) newSession(region string) (*session.Session, error) {
+	base, err := self.newBaseSession(region)
+	if err != nil || self.RoleArn == "" {
+		return base, err
+	}
+	provider := stscreds.NewCredentials(base, self.RoleArn, func(p *stscreds.AssumeRoleProvider) {
+		p.RoleSessionName = self.RoleSessionName
+		p.ExpiryWindow = ROLE_EXPIRY_WINDOW
+		if self.ExternalId != "" {
+			p.ExternalID = aws.String(self.ExternalId)
+		}
+	})
+	return base.Copy(&aws.Config{Credentials: provider}), nil
+}
+
+// newBaseSession returns a session for region using the configured credential
+// source. CREDENTIALS_DEFAULT leaves the lookup to the SDK default chain:
+// environment, shared credentials file, web identity token and instance role.
+func (self *Account) newBaseSession(region string) (*session.Session, error) {
+	config := aws.NewConfig().WithRegion(region).WithHTTPClient(self.Http.newClient())
+	if self.CredentialSource == CREDENTIALS_DEFAULT || self.CredentialSource == "" {
+		options := session.Options{}
+		options.Config = *config
+		options.Profile = self.Profile
+		options.SharedConfigState = session.SharedConfigEnable
+		return session.NewSessionWithOptions(options)
+	}
+	base, err := session.NewSession(config)
+	if err != nil {
+		return nil, err
+	}
+	var provider *credentials.Credentials
+	switch self.CredentialSource {
+	case CREDENTIALS_STATIC:
+		provider = credentials.NewStaticCredentials(self.AccessKeyId, self.SecretAccessKey, "")
+	case CREDENTIALS_ENVIRONMENT:
+		provider = credentials.NewEnvCredentials()
+	case CREDENTIALS_SHARED:
+		provider = credentials.NewSharedCredentials(self.CredentialsFile, self.Profile)
+	case CREDENTIALS_EC2ROLE:
+		provider = ec2rolecreds.NewCredentials(base)
+	case CREDENTIALS_WEBIDENTITY:
+		provider = stscreds.NewWebIdentityCredentials(base, self.WebIdentityRoleArn, SESSION_NAME,
+			self.WebIdentityTokenFile)
+	default:
+		return nil, fmt.Errorf("Invalid CredentialSource '%v' in Account '%v'", self.CredentialSource, self.Name)
+	}
+	return base.Copy(&aws.Config{Credentials: provider}), nil
+}
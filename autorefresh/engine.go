@@ -1,6 +1,9 @@
 package autorefresh
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/robfig/cron"
 	"os"
 	"os/signal"
@@ -11,24 +14,46 @@ import (
 
 const INSTANCE_MAX_AGE = time.Minute * 120
 
+// RefreshResult records the outcome of a single Refresh run.
+type RefreshResult struct {
+	Project       string
+	Account       string
+	Region        string
+	SourceAmiId   string
+	InstanceId    string
+	AmiId         string
+	ConsoleOutput string
+	FailureReason string
+	StartTime     time.Time
+	EndTime       time.Time
+}
+
 type AutoRefreshAmi struct {
-	Account        *Account
-	LaunchConfig   LaunchConfig
-	RetentionCount uint
-	Cron           string
-	Name           string
-	logFields      map[string]interface{}
-	ConfigErrors   int
-	waitGroup      *sync.WaitGroup
+	Account       *Account
+	LaunchConfig  LaunchConfig
+	Retention     RetentionPolicy
+	KeepSnapshots bool
+	Cron          string
+	Name          string
+	BuildTimeout  time.Duration
+	AmiTimeout    time.Duration
+	ConsoleOutput ConsoleOutputConfig
+	logFields     map[string]interface{}
+	ConfigErrors  int
+	waitGroup     *sync.WaitGroup
 }
 
 func (self *AutoRefreshAmi) Copy() AutoRefreshAmi {
 	newARA := AutoRefreshAmi{}
 	newARA.Account = self.Account
 	newARA.LaunchConfig = self.LaunchConfig.Copy()
-	newARA.RetentionCount = self.RetentionCount
+	newARA.Retention = self.Retention
+	newARA.KeepSnapshots = self.KeepSnapshots
 	newARA.Cron = self.Cron
 	newARA.Name = self.Name
+	newARA.BuildTimeout = self.BuildTimeout
+	newARA.AmiTimeout = self.AmiTimeout
+	newARA.ConsoleOutput = self.ConsoleOutput
 	newARA.logFields = make(map[string]interface{})
 	newARA.ConfigErrors = 0
 	newARA.waitGroup = self.waitGroup
@@ -42,175 +67,392 @@ func (self *AutoRefreshAmi) resetLogFields() {
 	self.logFields["AmiId"] = self.LaunchConfig.Source.AmiId
 }
 
-func (self *AutoRefreshAmi) check(e error, errorType string) {
-	if errorType != "" {
-		self.logFields["Type"] = errorType
-	}
-	if e != nil {
-		self.logFields["Account"] = self.Account.Name
-		self.logFields["Region"] = self.LaunchConfig.Source.Region
-		self.logFields["AmiId"] = self.LaunchConfig.Source.AmiId
-		log.WithFields(self.logFields).Panic(e)
+func (self *AutoRefreshAmi) wrapError(kind ErrorKind, op string, err error) error {
+	e := newError(kind, op, err)
+	e.Project = self.Name
+	if e.Account == "" && self.Account != nil {
+		e.Account = self.Account.Name
 	}
-}
-
-func (self *AutoRefreshAmi) recoverPanic() {
-	err := recover()
-	if err != nil {
-		self.ConfigErrors++
-		log.WithFields(self.logFields).Info("Recovering from errors, aborted last job!")
+	if e.Region == "" {
+		e.Region = self.LaunchConfig.Source.Region
 	}
+	return e
 }
 
-func (self *AutoRefreshAmi) panicIfErrorsFound() {
-	if self.ConfigErrors > 0 {
-		self.resetLogFields()
-		self.logFields["Type"] = "Syntax Errors"
-		self.logFields["ErrorCount"] = self.ConfigErrors
-		log.WithFields(self.logFields).Panic("Config validation failed, exiting...")
-	}
+func (self *AutoRefreshAmi) fail(kind ErrorKind, op string, err error) error {
+	err = self.wrapError(kind, op, err)
+	self.ConfigErrors++
+	self.logFields["Type"] = op
+	log.WithFields(self.logFields).Errorf("Aborted job, message: %v", err)
+	return err
 }
 
 func (self *AutoRefreshAmi) Validate() error {
 	self.resetLogFields()
 	self.logFields["Type"] = "Config Validation"
 	if self.Account == nil {
-		log.WithFields(self.logFields).Panic("Account not found")
-	} else {
-		if err := self.Account.validateAndSetDefaults(); err != nil {
-			log.WithFields(self.logFields).Panic(err)
-		}
+		return self.wrapError(ConfigError, "Validate", errors.New("Account not found"))
+	}
+	if err := self.Account.validateAndSetDefaults(); err != nil {
+		return self.wrapError(ConfigError, "Validate", err)
 	}
 	if err := self.LaunchConfig.validate(); err != nil {
-		log.WithFields(self.logFields).Panic(err)
+		return self.wrapError(ConfigError, "Validate", err)
 	}
-	if self.RetentionCount <= 0 {
-		log.WithFields(self.logFields).Panic("RetentionCount is configured as 0")
+	if self.Retention.isEmpty() {
+		return self.wrapError(ConfigError, "Validate", errors.New("Retention policy keeps no AMI"))
 	}
 	if self.Cron == "" {
 		log.Warning("Cron not configured, the engine will run only once for creating AMI")
 	}
 	if self.Name == "" {
-		log.WithFields(self.logFields).Panic("Name field missing")
+		return self.wrapError(ConfigError, "Validate", errors.New("Name field missing"))
 	}
 	return nil
 }
 
-func (self *AutoRefreshAmi) Refresh() {
+func (self *AutoRefreshAmi) newResult() *RefreshResult {
+	result := RefreshResult{}
+	result.Project = self.Name
+	result.Account = self.Account.Name
+	result.Region = self.LaunchConfig.Source.Region
+	result.SourceAmiId = self.LaunchConfig.Source.AmiId
+	result.StartTime = time.Now()
+	return &result
+}
+
+func (self *AutoRefreshAmi) Refresh(ctx context.Context) (result *RefreshResult, err error) {
 	if self.Cron != "" {
 		self.waitGroup.Add(1)
 	}
 	defer self.waitGroup.Done()
-	defer self.recoverPanic()
 
 	self.resetLogFields()
-	autoInstance, err := self.Account.LaunchInstance(&self.LaunchConfig)
-	self.check(err, "LaunchInstance")
+	result = self.newResult()
+	defer func() {
+		result.EndTime = time.Now()
+		if err != nil && result.FailureReason == "" {
+			result.FailureReason = err.Error()
+		}
+	}()
+
+	autoInstance, err := self.Account.LaunchInstance(ctx, &self.LaunchConfig)
+	if err != nil {
+		return result, self.fail(LaunchError, "LaunchInstance", err)
+	}
+	result.InstanceId = autoInstance.Id
 	defer autoInstance.Terminate()
 
-	err = autoInstance.WaitForStoppedState()
-	self.check(err, "StopInstance")
+	buildCtx, cancelBuild := withOptionalTimeout(ctx, self.BuildTimeout)
+	err = autoInstance.WaitForStoppedState(buildCtx)
+	console := self.fetchConsoleOutput(buildCtx, autoInstance, err == nil)
+	cancelBuild()
+	result.ConsoleOutput = self.saveConsoleOutput(autoInstance, console)
+	if err != nil {
+		if err == context.DeadlineExceeded && ctx.Err() == nil {
+			err = fmt.Errorf("builder did not stop within %v", self.BuildTimeout)
+			return result, self.fail(TimeoutError, "StopInstance", err)
+		}
+		if failure, ok := err.(*InstanceFailure); ok {
+			result.FailureReason = failure.Reason()
+		}
+		return result, self.fail(BuildError, "StopInstance", err)
+	}
+	if err = parseBuildResult(console); err != nil {
+		result.FailureReason = err.Error()
+		return result, self.fail(BuildError, "CheckBuildResult", err)
+	}
 
 	autoAmi, err := autoInstance.CreateAmi(self.Name)
-	self.check(err, "CreateAmi")
-	defer autoAmi.DeleteOldAmi(self.Account.OwnerId, self.RetentionCount)
+	if err != nil {
+		return result, self.fail(AmiCreationError, "CreateAmi", err)
+	}
+	result.AmiId = autoAmi.Id
+	defer func() {
+		// Prune only once a replacement image is available
+		if err != nil {
+			return
+		}
+		autoscaling, retentionErr := self.Account.ConnectToAutoscaling(self.LaunchConfig.Source.Region)
+		if retentionErr != nil {
+			err = self.fail(RetentionError, "ConnectToAutoscaling", retentionErr)
+			return
+		}
+		autoAmi.Autoscaling = autoscaling
+		_, retentionErr = autoAmi.DeleteOldAmi(self.Account.OwnerId, &self.Retention, !self.KeepSnapshots)
+		if retentionErr != nil {
+			err = self.fail(RetentionError, "DeleteOldAmi", retentionErr)
+		}
+	}()
 
-	err = autoAmi.WaitForAvailableState()
-	self.check(err, "WaitForAmiAvailableState")
+	amiCtx, cancelAmi := withOptionalTimeout(ctx, self.AmiTimeout)
+	err = autoAmi.WaitForAvailableState(amiCtx)
+	cancelAmi()
+	if err != nil {
+		if amiCtx.Err() != nil {
+			// Do not leave a half baked image behind
+			autoAmi.Deregister()
+		}
+		if err == context.DeadlineExceeded && ctx.Err() == nil {
+			err = fmt.Errorf("AMI %v not available within %v", autoAmi.Id, self.AmiTimeout)
+			return result, self.fail(TimeoutError, "WaitForAmiAvailableState", err)
+		}
+		return result, self.fail(AmiCreationError, "WaitForAmiAvailableState", err)
+	}
+	log.WithFields(self.logFields).Infof("Refresh complete, new AMI: %v, console output: %v",
+		autoAmi.Id, result.ConsoleOutput)
+	return result, nil
 }
 
-func (self *AutoRefreshAmi) CleanUp() {
+func (self *AutoRefreshAmi) consoleStore() (ConsoleStore, error) {
+	if self.ConsoleOutput.S3Bucket == "" {
+		directory := self.ConsoleOutput.Directory
+		if directory == "" {
+			directory = DEFAULT_CONSOLE_OUTPUT_DIRECTORY
+		}
+		return &LocalConsoleStore{Directory: directory}, nil
+	}
+	region := self.ConsoleOutput.S3Region
+	if region == "" {
+		region = self.LaunchConfig.Source.Region
+	}
+	connection, err := self.Account.ConnectToS3(region)
+	if err != nil {
+		return nil, err
+	}
+	store := S3ConsoleStore{}
+	store.Bucket = self.ConsoleOutput.S3Bucket
+	store.Prefix = self.ConsoleOutput.S3Prefix
+	store.Connection = connection
+	return &store, nil
+}
+
+// fetchConsoleOutput returns the builder console output. EC2 may publish
+// buffered output some time after the instance stops, so when the build is
+// expected to have completed the output is polled until the build result
+// marker shows up, for at most ConsoleOutput.Timeout and until ctx is done.
+func (self *AutoRefreshAmi) fetchConsoleOutput(ctx context.Context, autoInstance *AutoInstance, waitForResult bool) string {
+	timeout := self.ConsoleOutput.timeout
+	if timeout <= 0 {
+		timeout, _ = parseTimeout(DEFAULT_CONSOLE_OUTPUT_TIMEOUT)
+	}
+	waitCtx, cancel := withOptionalTimeout(ctx, timeout)
+	defer cancel()
+	var output string
+	var err error
+	for i := 1; ; i++ {
+		output, err = autoInstance.ConsoleOutput()
+		if !waitForResult || (err == nil && parseBuildResult(output) != ErrBuildResultMissing) {
+			break
+		}
+		log.WithFields(self.logFields).Debugf("Build result not in console output of instance %v yet, Try # %v",
+			autoInstance.Id, i)
+		if sleepWithContext(waitCtx, POLL_INTERVAL) != nil {
+			break
+		}
+	}
+	if err != nil {
+		log.WithFields(self.logFields).Warningf("Unable to fetch console output of instance %v, message: %v",
+			autoInstance.Id, err)
+	}
+	return output
+}
+
+// saveConsoleOutput stores the builder console output and returns where it
+// went. Failures are logged only, they never fail the job.
+func (self *AutoRefreshAmi) saveConsoleOutput(autoInstance *AutoInstance, output string) string {
+	if output == "" {
+		return ""
+	}
+	name := consoleOutputName(self.Name, autoInstance.Region, autoInstance.Id, autoInstance.LaunchTime)
+	location := ""
+	store, err := self.consoleStore()
+	if err == nil {
+		location, err = store.Store(name, []byte(output))
+	}
+	if err != nil {
+		log.WithFields(self.logFields).Warningf("Unable to store console output of instance %v, message: %v",
+			autoInstance.Id, err)
+		return ""
+	}
+	log.WithFields(self.logFields).Infof("Console output of instance %v stored at %v", autoInstance.Id, location)
+	return location
+}
+
+func (self *AutoRefreshAmi) CleanUp(ctx context.Context) error {
 	if self.Cron != "" {
 		self.waitGroup.Add(1)
 	}
 	defer self.waitGroup.Done()
-	defer self.recoverPanic()
 
 	self.resetLogFields()
 	instancesFound, err := self.Account.FindInstances(&self.LaunchConfig)
-	self.check(err, "FindInstances")
+	if err != nil {
+		return self.fail(CleanUpError, "FindInstances", err)
+	}
+	legacy, err := self.legacyInstances()
+	if err != nil {
+		return self.fail(CleanUpError, "FindInstances", err)
+	}
+	*instancesFound = append(*instancesFound, legacy...)
 
 	log.WithFields(self.logFields).Infof("%v matching instances found, old instances will be terminated", len(*instancesFound))
 	for _, autoInst := range *instancesFound {
+		if err := ctx.Err(); err != nil {
+			return self.fail(CleanUpError, "TerminateInstance", err)
+		}
 		timeOld := time.Since(autoInst.LaunchTime)
 		if (timeOld > INSTANCE_MAX_AGE) && autoInst.State == "stopped" {
 			autoInst.Terminate()
 		}
 	}
+	return nil
+}
+
+// newJob returns the job of project for no source in particular. It fails
+// when the Account or UserData of project is not defined.
+func (self *ConfigStorage) newJob(project *Project) (*AutoRefreshAmi, error) {
+	account, accountFound := self.accounts[project.Account]
+	userData, userDataFound := self.userdatas[project.UserData]
+	if !accountFound || !userDataFound {
+		return nil, &Error{Kind: ConfigError, Op: "newJob", Project: project.Name,
+			Err: errors.New("Account or UserData is not defined")}
+	}
+	refreshAmi := AutoRefreshAmi{}
+	launchConfig := LaunchConfig{}
+	refreshAmi.waitGroup = &self.GoWait
+	// Configure account
+	refreshAmi.Account = account
+	// Configure LaunchConfig
+	launchConfig.UserData = userData.Bash
+	launchConfig.InstanceType = project.InstanceType
+	launchConfig.Tags = project.Tags
+	launchConfig.Ebs = project.EbsVolumes
+	refreshAmi.LaunchConfig = launchConfig
+	// Cron and retention count
+	refreshAmi.Retention = project.Retention
+	refreshAmi.KeepSnapshots = project.KeepSnapshots
+	refreshAmi.Cron = project.Cron
+	refreshAmi.Name = project.Name
+	refreshAmi.BuildTimeout = project.buildTimeout
+	refreshAmi.AmiTimeout = project.amiTimeout
+	refreshAmi.ConsoleOutput = project.ConsoleOutput
+	return &refreshAmi, nil
+}
+
+// projectJobs returns one job for every source matched by project.
+func (self *ConfigStorage) projectJobs(project *Project) ([]AutoRefreshAmi, error) {
+	refreshAmi, err := self.newJob(project)
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]AutoRefreshAmi, 0)
+	for _, source := range project.SourceFilter.findSources(&self.sources) {
+		newRefreshAmi := refreshAmi.Copy()
+		newRefreshAmi.LaunchConfig.Source = source.Copy()
+		newRefreshAmi.LaunchConfig.setIdentity(project.Name)
+		jobs = append(jobs, newRefreshAmi)
+	}
+	return jobs, nil
 }
 
-func StartEngine(cs *ConfigStorage) {
+// StartEngine schedules a refresh and a cleanup job for every project and
+// matching source, and a prune job per retention scope of projects with a
+// PruneCron. It returns once all jobs are done, or after ctx is canceled or a
+// SIGINT/SIGTERM is received and the in-flight jobs have been aborted.
+func StartEngine(ctx context.Context, cs *ConfigStorage) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	cronRunner := cron.New()
 	for _, project := range cs.projects {
-		refreshAmi := AutoRefreshAmi{}
-		launchConfig := LaunchConfig{}
-		refreshAmi.waitGroup = &cs.GoWait
-		// Configure account
-		refreshAmi.Account = cs.accounts[project.Account]
-		// Configure LaunchConfig
-		launchConfig.UserData = cs.userdatas[project.UserData].Bash
-		launchConfig.InstanceType = project.InstanceType
-		launchConfig.Tags = project.Tags
-		launchConfig.Ebs = project.EbsVolumes
-		refreshAmi.LaunchConfig = launchConfig
-		// Cron and retention count
-		refreshAmi.RetentionCount = project.RetentionCount
-		refreshAmi.Cron = project.Cron
-		refreshAmi.Name = project.Name
-		// Apply source filter and start go routines
-		for _, source := range project.SourceFilter.findSources(&cs.sources) {
-			newRefreshAmi := refreshAmi.Copy()
-			newRefreshAmi.LaunchConfig.Source = source.Copy()
+		jobs, err := cs.projectJobs(project)
+		if err != nil {
+			log.Errorf("Skipping Project '%v', its Account or UserData is not defined", project.Name)
+			continue
+		}
+		// Start go routines
+		for index := range jobs {
+			newRefreshAmi := jobs[index]
 			if newRefreshAmi.Cron == "" {
 				cs.GoWait.Add(2)
-				go newRefreshAmi.Refresh()
-				go newRefreshAmi.CleanUp()
+				go newRefreshAmi.Refresh(ctx)
+				go newRefreshAmi.CleanUp(ctx)
 			} else {
-				cronRunner.AddFunc(newRefreshAmi.Cron, newRefreshAmi.Refresh)
-				cronRunner.AddFunc(newRefreshAmi.Cron, newRefreshAmi.CleanUp)
+				scheduleJob(cronRunner, newRefreshAmi.Cron, project.Name, func() { newRefreshAmi.Refresh(ctx) })
+				scheduleJob(cronRunner, newRefreshAmi.Cron, project.Name, func() { newRefreshAmi.CleanUp(ctx) })
 			}
 		}
+		if project.PruneCron == "" {
+			continue
+		}
+		// Retention on its own schedule, once per region and source identity
+		pruneJobs, _ := cs.retentionJobs(project)
+		for index := range pruneJobs {
+			pruneAmi := pruneJobs[index]
+			scheduleJob(cronRunner, project.PruneCron, project.Name, func() {
+				cs.GoWait.Add(1)
+				defer cs.GoWait.Done()
+				pruneAmi.Prune(ctx, false)
+			})
+		}
 	}
 	if len(cronRunner.Entries()) > 0 {
 		log.Infof("Starting cron runner with %v jobs", len(cronRunner.Entries()))
 		cronRunner.Start()
 		// Listen for interrupt signals from system
-		receiveSystemSignals(false)
-		// Stop cron. Note: running goroutines will continue to run
+		receiveSystemSignals(ctx, cancel, false)
+		// Stop cron and abort running jobs
 		cronRunner.Stop()
 		log.Info("Cron runner stopped")
+		cancel()
 	}
 	log.Info("Waiting for running jobs to finish..")
-	go receiveSystemSignals(true)
+	// ctx may already be canceled, keep listening until the jobs are done
+	waitCtx, stopWaiting := context.WithCancel(context.Background())
+	go receiveSystemSignals(waitCtx, cancel, true)
 	cs.GoWait.Wait()
+	stopWaiting()
 	log.Info("All jobs complete, exiting!")
 }
 
-func receiveSystemSignals(redundant bool) (value os.Signal) {
+// scheduleJob adds job to runner, logging the schedules cron cannot parse.
+func scheduleJob(runner *cron.Cron, spec string, project string, job func()) {
+	if err := runner.AddFunc(spec, job); err != nil {
+		log.Errorf("Skipping schedule '%v' of Project '%v': %v", spec, project, err)
+	}
+}
+
+// receiveSystemSignals waits for SIGINT or SIGTERM. The first listener
+// returns on the signal or once ctx is done. The redundant one cancels on the
+// first signal, aborts the process on another one within 5 seconds, and
+// returns once ctx is done.
+func receiveSystemSignals(ctx context.Context, cancel context.CancelFunc, redundant bool) (value os.Signal) {
 	stopSignal := make(chan os.Signal, 5)
+	signal.Notify(stopSignal, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(stopSignal)
 	if redundant == false {
-		signal.Notify(stopSignal, syscall.SIGINT, syscall.SIGTERM)
-		value = <-stopSignal
-		log.Infof("Received os signal '%v', attempting graceful shutdown", value)
-	} else {
-		safeAck := true
-		for {
-			signal.Notify(stopSignal, syscall.SIGINT, syscall.SIGTERM)
-			value = <-stopSignal
-			if safeAck {
-				log.Infof("Received os signal '%v', graceful shutdown initiated", value)
-				safeAck = false
-				go makeBoolTrueAfterDelay(&safeAck, 5*time.Second)
-			} else {
-				log.Warningf("Received os signal '%v' multiple times... Abort process!", value)
-				panic(value)
-			}
+		select {
+		case value = <-stopSignal:
+			log.Infof("Received os signal '%v', attempting graceful shutdown", value)
+		case <-ctx.Done():
+			log.Infof("Engine context done, attempting graceful shutdown")
+		}
+		return
+	}
+	var acked time.Time
+	for {
+		select {
+		case value = <-stopSignal:
+		case <-ctx.Done():
+			return
+		}
+		if acked.IsZero() || time.Since(acked) > 5*time.Second {
+			log.Infof("Received os signal '%v', graceful shutdown initiated", value)
+			cancel()
+			acked = time.Now()
+		} else {
+			log.Warningf("Received os signal '%v' multiple times... Abort process!", value)
+			panic(value)
 		}
 	}
-	return
-}
-
-func makeBoolTrueAfterDelay(value *bool, delay time.Duration) {
-	time.Sleep(delay)
-	*value = true
 }
@@ -0,0 +1,203 @@
+package autorefresh
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func init() {
+	POLL_INTERVAL = time.Millisecond
+}
+
+// newTestJob returns a job building from ami-source in us-east-1 against fake.
+func newTestJob(t *testing.T, fake *FakeEc2) *AutoRefreshAmi {
+	directory, err := ioutil.TempDir("", "autorefresh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	account := &Account{Name: "test", OwnerId: fake.OwnerId}
+	account.ClientFactory = fake.Factory()
+	account.AutoscalingFactory = NewFakeAutoscaling().Factory()
+	job := &AutoRefreshAmi{}
+	job.Account = account
+	job.Name = "test"
+	job.Retention = RetentionPolicy{KeepLast: 2}
+	job.ConsoleOutput.Directory = directory
+	job.waitGroup = &sync.WaitGroup{}
+	job.LaunchConfig = LaunchConfig{
+		UserData:     "#!/bin/bash",
+		InstanceType: "t2.nano",
+		Source:       Source{AmiId: "ami-source", Region: "us-east-1"},
+		Tags:         map[string]string{TAG_MAINTAINED_BY: "AutoRefreshAmi", TAG_PROJECT: "test"},
+	}
+	return job
+}
+
+func testTags(tags map[string]string) []*ec2.Tag {
+	ec2Tags := make([]*ec2.Tag, 0)
+	for key, value := range tags {
+		ec2Tags = append(ec2Tags, &ec2.Tag{Key: aws.String(key), Value: aws.String(value)})
+	}
+	return ec2Tags
+}
+
+func TestRefresh(t *testing.T) {
+	fake := NewFakeEc2("111111111111")
+	job := newTestJob(t, fake)
+	defer os.RemoveAll(job.ConsoleOutput.Directory)
+	created := time.Now().UTC().Add(-72 * time.Hour)
+	existing := make([]string, 0)
+	for i := 0; i < 3; i++ {
+		existing = append(existing, fake.AddImage(&ec2.Image{
+			CreationDate: aws.String(created.Add(time.Duration(i) * time.Hour).Format(time.RFC3339)),
+			Tags:         testTags(job.LaunchConfig.Tags),
+		}))
+	}
+	fake.AddImage(&ec2.Image{CreationDate: aws.String(created.Format(time.RFC3339))})
+
+	job.waitGroup.Add(1)
+	result, err := job.Refresh(context.Background())
+	if err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if result.AmiId == "" || fake.Image(result.AmiId) == nil {
+		t.Fatalf("New AMI %q not found", result.AmiId)
+	}
+	if state := aws.StringValue(fake.Instance(result.InstanceId).State.Name); state != "terminated" {
+		t.Errorf("Builder %v left %v", result.InstanceId, state)
+	}
+	if result.ConsoleOutput == "" {
+		t.Errorf("Console output not stored")
+	}
+	// The new image and the newest existing one are kept
+	for i, id := range existing {
+		if deleted := fake.Image(id) == nil; deleted != (i < 2) {
+			t.Errorf("AMI %v deleted: %v", id, deleted)
+		}
+	}
+	if fake.Calls("DeregisterImage") != 2 {
+		t.Errorf("DeregisterImage called %v times, expected 2", fake.Calls("DeregisterImage"))
+	}
+}
+
+func TestRefreshLaunchFailure(t *testing.T) {
+	fake := NewFakeEc2("111111111111")
+	fake.Errors["RunInstances"] = awserr.New("InsufficientInstanceCapacity", "no capacity", nil)
+	job := newTestJob(t, fake)
+	defer os.RemoveAll(job.ConsoleOutput.Directory)
+
+	job.waitGroup.Add(1)
+	result, err := job.Refresh(context.Background())
+	if KindOf(err) != LaunchError {
+		t.Fatalf("Expected a LaunchError, got %v", err)
+	}
+	if result.InstanceId != "" || result.AmiId != "" || result.FailureReason == "" {
+		t.Errorf("Unexpected result: %+v", result)
+	}
+	if fake.Calls("CreateImage") != 0 || fake.Calls("DeregisterImage") != 0 {
+		t.Errorf("Images touched after a failed launch")
+	}
+}
+
+func TestCleanUp(t *testing.T) {
+	fake := NewFakeEc2("111111111111")
+	job := newTestJob(t, fake)
+	defer os.RemoveAll(job.ConsoleOutput.Directory)
+	old := time.Now().Add(-2 * INSTANCE_MAX_AGE)
+	instances := []struct {
+		state      string
+		launchTime time.Time
+		tags       map[string]string
+		terminated bool
+	}{
+		{"stopped", old, job.LaunchConfig.Tags, true},
+		{"running", old, job.LaunchConfig.Tags, false},
+		{"stopped", time.Now(), job.LaunchConfig.Tags, false},
+		{"stopped", old, map[string]string{"role": "other"}, false},
+		// launched before identity tags were introduced
+		{"stopped", old, map[string]string{TAG_MAINTAINED_BY: "AutoRefreshAmi"}, true},
+		{"stopped", old, map[string]string{TAG_MAINTAINED_BY: "AutoRefreshAmi", TAG_PROJECT: "other"}, false},
+	}
+	ids := make([]string, 0)
+	for _, instance := range instances {
+		ids = append(ids, fake.AddInstance(&ec2.Instance{
+			State:      &ec2.InstanceState{Name: aws.String(instance.state)},
+			LaunchTime: aws.Time(instance.launchTime),
+			Tags:       testTags(instance.tags),
+		}))
+	}
+
+	job.waitGroup.Add(1)
+	if err := job.CleanUp(context.Background()); err != nil {
+		t.Fatalf("CleanUp failed: %v", err)
+	}
+	for i, instance := range instances {
+		state := aws.StringValue(fake.Instance(ids[i]).State.Name)
+		if (state == "terminated") != instance.terminated {
+			t.Errorf("Instance %v (%v): %v", ids[i], fmt.Sprint(instance.state, " ", instance.launchTime), state)
+		}
+	}
+}
+
+func TestRefreshTimeout(t *testing.T) {
+	tests := []struct {
+		name       string
+		configure  func(fake *FakeEc2, job *AutoRefreshAmi)
+		op         string
+		deregister int
+	}{
+		{"builder never stops", func(fake *FakeEc2, job *AutoRefreshAmi) {
+			fake.InstanceLifecycle = []string{"pending", "running"}
+			job.BuildTimeout = 20 * time.Millisecond
+		}, "StopInstance", 0},
+		{"image never available", func(fake *FakeEc2, job *AutoRefreshAmi) {
+			fake.ImageLifecycle = []string{"pending"}
+			job.AmiTimeout = 20 * time.Millisecond
+		}, "WaitForAmiAvailableState", 1},
+	}
+	for _, test := range tests {
+		fake := NewFakeEc2("111111111111")
+		job := newTestJob(t, fake)
+		test.configure(fake, job)
+
+		job.waitGroup.Add(1)
+		result, err := job.Refresh(context.Background())
+		os.RemoveAll(job.ConsoleOutput.Directory)
+		if e, ok := err.(*Error); !ok || e.Kind != TimeoutError || e.Op != test.op {
+			t.Errorf("%v: expected a TimeoutError in %v, got %v", test.name, test.op, err)
+			continue
+		}
+		if state := aws.StringValue(fake.Instance(result.InstanceId).State.Name); state != "terminated" {
+			t.Errorf("%v: builder %v left %v", test.name, result.InstanceId, state)
+		}
+		if fake.Calls("DeregisterImage") != test.deregister {
+			t.Errorf("%v: DeregisterImage called %v times, expected %v", test.name,
+				fake.Calls("DeregisterImage"), test.deregister)
+		}
+	}
+}
+
+func TestReceiveSystemSignalsReturns(t *testing.T) {
+	for _, redundant := range []bool{false, true} {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			receiveSystemSignals(ctx, cancel, redundant)
+			close(done)
+		}()
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Errorf("redundant %v: still listening after ctx is done", redundant)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package autorefresh
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+type ErrorKind int
+
+const (
+	UnknownError ErrorKind = iota
+	ConfigError
+	LaunchError
+	BuildError
+	AmiCreationError
+	TimeoutError
+	RetentionError
+	CleanUpError
+	CanceledError
+	ConfigWarning
+)
+
+var ERRORKIND_NAMES map[ErrorKind]string = map[ErrorKind]string{
+	UnknownError:     "unknown error",
+	ConfigError:      "config error",
+	LaunchError:      "launch error",
+	BuildError:       "build error",
+	AmiCreationError: "ami creation error",
+	TimeoutError:     "timeout",
+	RetentionError:   "retention error",
+	CleanUpError:     "cleanup error",
+	CanceledError:    "canceled",
+	ConfigWarning:    "config warning",
+}
+
+func (self ErrorKind) String() string {
+	name, ok := ERRORKIND_NAMES[self]
+	if !ok {
+		return ERRORKIND_NAMES[UnknownError]
+	}
+	return name
+}
+
+// Error is returned by every exported operation of this package. Kind tells
+// the failure class apart, the remaining fields say where it happened.
+type Error struct {
+	Kind    ErrorKind
+	Op      string
+	Project string
+	Account string
+	Region  string
+	File    string
+	Line    int
+	Err     error
+}
+
+func (self *Error) Error() string {
+	context := make([]string, 0)
+	if self.Project != "" {
+		context = append(context, fmt.Sprintf("project=%v", self.Project))
+	}
+	if self.Account != "" {
+		context = append(context, fmt.Sprintf("account=%v", self.Account))
+	}
+	if self.Region != "" {
+		context = append(context, fmt.Sprintf("region=%v", self.Region))
+	}
+	if self.File != "" && self.Line > 0 {
+		context = append(context, fmt.Sprintf("file=%v:%v", self.File, self.Line))
+	} else if self.File != "" {
+		context = append(context, fmt.Sprintf("file=%v", self.File))
+	}
+	message := self.Kind.String()
+	if self.Op != "" {
+		message = fmt.Sprintf("%v in %v", message, self.Op)
+	}
+	if len(context) > 0 {
+		message = fmt.Sprintf("%v (%v)", message, strings.Join(context, ", "))
+	}
+	if self.Err != nil {
+		message = fmt.Sprintf("%v: %v", message, self.Err)
+	}
+	return message
+}
+
+func (self *Error) Unwrap() error {
+	return self.Err
+}
+
+func newError(kind ErrorKind, op string, err error) *Error {
+	if e, ok := err.(*Error); ok {
+		return e
+	}
+	switch err {
+	case context.Canceled:
+		kind = CanceledError
+	case context.DeadlineExceeded:
+		kind = TimeoutError
+	}
+	return &Error{Kind: kind, Op: op, Err: err}
+}
+
+// KindOf returns the ErrorKind of err, or UnknownError if err was not
+// produced by this package.
+func KindOf(err error) ErrorKind {
+	if e, ok := err.(*Error); ok {
+		return e.Kind
+	}
+	return UnknownError
+}
+
+// InstanceFailure describes a builder instance which died or got impaired
+// instead of stopping on its own.
+type InstanceFailure struct {
+	InstanceId    string
+	State         string
+	ReasonCode    string
+	ReasonMessage string
+	StatusCheck   string
+}
+
+// Reason returns the most specific description available for the failure.
+func (self *InstanceFailure) Reason() string {
+	switch {
+	case self.StatusCheck != "":
+		return self.StatusCheck
+	case self.ReasonCode != "":
+		return self.ReasonCode
+	default:
+		return fmt.Sprintf("instance %v", self.State)
+	}
+}
+
+func (self *InstanceFailure) Error() string {
+	message := fmt.Sprintf("instance %v is %v", self.InstanceId, self.State)
+	if self.StatusCheck != "" {
+		return fmt.Sprintf("%v, %v", message, self.StatusCheck)
+	}
+	if self.ReasonCode != "" {
+		message = fmt.Sprintf("%v: %v", message, self.ReasonCode)
+	}
+	if self.ReasonMessage != "" && self.ReasonMessage != self.ReasonCode {
+		message = fmt.Sprintf("%v (%v)", message, self.ReasonMessage)
+	}
+	return message
+}
+
+// ErrorList collects independent errors, e.g. one per broken config file.
+type ErrorList []error
+
+func (self ErrorList) Error() string {
+	messages := make([]string, 0)
+	for _, err := range self {
+		messages = append(messages, err.Error())
+	}
+	return fmt.Sprintf("%v error(s) found:\n  %v", len(self), strings.Join(messages, "\n  "))
+}
@@ -0,0 +1,807 @@
+package autorefresh
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FakeEc2 is an in-memory Ec2Client. Every DescribeInstances or DescribeImages
+// call moves the matching resources one step along InstanceLifecycle or
+// ImageLifecycle, so a launched builder eventually reports "stopped" and a
+// created image eventually reports "available". StateReason is reported once
+// an instance reaches the last lifecycle state, InstanceStatus is returned by
+// DescribeInstanceStatus for running instances. The latest console output is
+// only served with LatestConsole set, as on Nitro instances, otherwise the
+// buffered output is expected. A non zero PageSize splits
+// Describe* results into pages of that size. EBS snapshots backing images are
+// kept until DeleteSnapshot, which refuses those still in use by an image.
+type FakeEc2 struct {
+	OwnerId           string
+	InstanceLifecycle []string
+	ImageLifecycle    []string
+	StateReason       string
+	InstanceStatus    string
+	ConsoleOutput     string
+	LatestConsole     bool
+	PageSize          int
+	Errors            map[string]error
+	instances         map[string]*fakeInstance
+	images            map[string]*fakeImage
+	snapshots         map[string]int64
+	templates         []*ec2.LaunchTemplateVersion
+	calls             map[string]int
+	sequence          int
+	epoch             time.Time
+	lock              sync.Mutex
+}
+
+type fakeInstance struct {
+	instance *ec2.Instance
+	step     int
+}
+
+type fakeImage struct {
+	image *ec2.Image
+	step  int
+}
+
+func NewFakeEc2(ownerId string) *FakeEc2 {
+	fake := FakeEc2{}
+	fake.OwnerId = ownerId
+	fake.InstanceLifecycle = []string{"pending", "running", "stopping", "stopped"}
+	fake.ImageLifecycle = []string{"pending", "available"}
+	fake.StateReason = "Client.InstanceInitiatedShutdown"
+	fake.InstanceStatus = "ok"
+	fake.ConsoleOutput = fmt.Sprintf("%v %v\n", BUILD_RESULT_MARKER, BUILD_RESULT_SUCCESS)
+	fake.Errors = make(map[string]error)
+	fake.instances = make(map[string]*fakeInstance)
+	fake.images = make(map[string]*fakeImage)
+	fake.snapshots = make(map[string]int64)
+	fake.calls = make(map[string]int)
+	fake.epoch = time.Now().UTC()
+	return &fake
+}
+
+// Factory returns an Ec2ClientFactory handing out this fake for every region.
+func (self *FakeEc2) Factory() Ec2ClientFactory {
+	return func(account *Account, region string) Ec2Client {
+		return self
+	}
+}
+
+// Calls returns how many times the given API operation has been invoked.
+func (self *FakeEc2) Calls(operation string) int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.calls[operation]
+}
+
+// AddImage seeds an image, as if it had been created earlier. The image is
+// stored as given; a missing ImageId, OwnerId or State is filled in.
+func (self *FakeEc2) AddImage(image *ec2.Image) string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if image.ImageId == nil {
+		image.ImageId = aws.String(self.nextId("ami"))
+	}
+	if image.OwnerId == nil {
+		image.OwnerId = aws.String(self.OwnerId)
+	}
+	if image.State == nil {
+		image.State = aws.String("available")
+	}
+	self.images[*image.ImageId] = &fakeImage{image: image, step: len(self.ImageLifecycle) - 1}
+	for _, mapping := range image.BlockDeviceMappings {
+		if mapping.Ebs != nil && mapping.Ebs.SnapshotId != nil {
+			self.snapshots[*mapping.Ebs.SnapshotId] = aws.Int64Value(mapping.Ebs.VolumeSize)
+		}
+	}
+	return *image.ImageId
+}
+
+// AddInstance seeds an instance, as if it had been launched earlier. The
+// instance is stored as given; a missing InstanceId, State or LaunchTime is
+// filled in.
+func (self *FakeEc2) AddInstance(instance *ec2.Instance) string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if instance.InstanceId == nil {
+		instance.InstanceId = aws.String(self.nextId("i"))
+	}
+	if instance.State == nil {
+		instance.State = &ec2.InstanceState{Name: aws.String(self.InstanceLifecycle[len(self.InstanceLifecycle)-1])}
+	}
+	if instance.LaunchTime == nil {
+		instance.LaunchTime = aws.Time(self.now())
+	}
+	self.instances[*instance.InstanceId] = &fakeInstance{instance: instance, step: len(self.InstanceLifecycle) - 1}
+	return *instance.InstanceId
+}
+
+// AddLaunchTemplate seeds a launch template with a single version, both
+// default and latest, launching imageId.
+func (self *FakeEc2) AddLaunchTemplate(name string, imageId string) string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	version := new(ec2.LaunchTemplateVersion)
+	version.LaunchTemplateId = aws.String(self.nextId("lt"))
+	version.LaunchTemplateName = aws.String(name)
+	version.VersionNumber = aws.Int64(1)
+	version.DefaultVersion = aws.Bool(true)
+	version.LaunchTemplateData = &ec2.ResponseLaunchTemplateData{ImageId: aws.String(imageId)}
+	self.templates = append(self.templates, version)
+	return *version.LaunchTemplateId
+}
+
+// AddLaunchTemplateVersion adds to the launch template a new latest version
+// launching imageId, made the default one with makeDefault, and returns its
+// number.
+func (self *FakeEc2) AddLaunchTemplateVersion(templateId string, imageId string, makeDefault bool) int64 {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	var latest *ec2.LaunchTemplateVersion
+	for _, version := range self.templates {
+		if aws.StringValue(version.LaunchTemplateId) != templateId {
+			continue
+		}
+		if makeDefault {
+			version.DefaultVersion = aws.Bool(false)
+		}
+		if latest == nil || aws.Int64Value(version.VersionNumber) > aws.Int64Value(latest.VersionNumber) {
+			latest = version
+		}
+	}
+	version := new(ec2.LaunchTemplateVersion)
+	version.LaunchTemplateId = aws.String(templateId)
+	version.LaunchTemplateName = latest.LaunchTemplateName
+	version.VersionNumber = aws.Int64(aws.Int64Value(latest.VersionNumber) + 1)
+	version.DefaultVersion = aws.Bool(makeDefault)
+	version.LaunchTemplateData = &ec2.ResponseLaunchTemplateData{ImageId: aws.String(imageId)}
+	self.templates = append(self.templates, version)
+	return *version.VersionNumber
+}
+
+// Snapshot tells if the EBS snapshot exists.
+func (self *FakeEc2) Snapshot(id string) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	_, ok := self.snapshots[id]
+	return ok
+}
+
+// Instance returns a copy of the stored instance, or nil if it does not exist.
+func (self *FakeEc2) Instance(id string) *ec2.Instance {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	found, ok := self.instances[id]
+	if !ok {
+		return nil
+	}
+	return copyInstance(found.instance)
+}
+
+// Image returns a copy of the stored image, or nil if it does not exist.
+func (self *FakeEc2) Image(id string) *ec2.Image {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	found, ok := self.images[id]
+	if !ok {
+		return nil
+	}
+	return copyImage(found.image)
+}
+
+// paginate returns the page of ids starting at nextToken. Pages hold at most
+// maxResults ids, further limited by PageSize when it is set.
+func (self *FakeEc2) paginate(ids []string, nextToken *string, maxResults *int64) ([]string, *string, error) {
+	sort.Strings(ids)
+	start := 0
+	if aws.StringValue(nextToken) != "" {
+		var err error
+		start, err = strconv.Atoi(*nextToken)
+		if err != nil || start < 0 || start > len(ids) {
+			return nil, nil, awserr.New("InvalidParameterValue",
+				fmt.Sprintf("Invalid NextToken '%v'", *nextToken), nil)
+		}
+	}
+	size := len(ids) - start
+	if maxResults != nil && int(*maxResults) < size {
+		size = int(*maxResults)
+	}
+	if self.PageSize > 0 && self.PageSize < size {
+		size = self.PageSize
+	}
+	end := start + size
+	if end >= len(ids) {
+		return ids[start:], nil, nil
+	}
+	return ids[start:end], aws.String(strconv.Itoa(end)), nil
+}
+
+func (self *FakeEc2) record(operation string) error {
+	self.calls[operation]++
+	return self.Errors[operation]
+}
+
+func (self *FakeEc2) nextId(prefix string) string {
+	self.sequence++
+	return fmt.Sprintf("%v-%08x", prefix, self.sequence)
+}
+
+func (self *FakeEc2) now() time.Time {
+	return self.epoch.Add(time.Duration(self.sequence) * time.Second)
+}
+
+func (self *FakeEc2) RunInstances(input *ec2.RunInstancesInput) (*ec2.Reservation, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if err := self.record("RunInstances"); err != nil {
+		return nil, err
+	}
+	instance := new(ec2.Instance)
+	instance.InstanceId = aws.String(self.nextId("i"))
+	instance.ImageId = aws.String(aws.StringValue(input.ImageId))
+	instance.InstanceType = aws.String(aws.StringValue(input.InstanceType))
+	instance.LaunchTime = aws.Time(self.now())
+	instance.State = &ec2.InstanceState{Name: aws.String(self.InstanceLifecycle[0])}
+	self.instances[*instance.InstanceId] = &fakeInstance{instance: instance}
+	reservation := new(ec2.Reservation)
+	reservation.Instances = []*ec2.Instance{copyInstance(instance)}
+	return reservation, nil
+}
+
+func (self *FakeEc2) DescribeInstances(input *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if err := self.record("DescribeInstances"); err != nil {
+		return nil, err
+	}
+	for _, id := range input.InstanceIds {
+		if _, ok := self.instances[*id]; !ok {
+			return nil, awserr.New("InvalidInstanceID.NotFound",
+				fmt.Sprintf("The instance ID '%v' does not exist", *id), nil)
+		}
+	}
+	matches := make([]string, 0)
+	for id, found := range self.instances {
+		if len(input.InstanceIds) > 0 && !containsString(input.InstanceIds, id) {
+			continue
+		}
+		if !matchFilters(input.Filters, found.instance.Tags) {
+			continue
+		}
+		if !matchValueFilter(input.Filters, "image-id", aws.StringValue(found.instance.ImageId)) ||
+			!matchValueFilter(input.Filters, "instance-state-name", aws.StringValue(found.instance.State.Name)) {
+			continue
+		}
+		matches = append(matches, id)
+	}
+	page, nextToken, err := self.paginate(matches, input.NextToken, input.MaxResults)
+	if err != nil {
+		return nil, err
+	}
+	reservation := new(ec2.Reservation)
+	for _, id := range page {
+		found := self.instances[id]
+		if found.step < len(self.InstanceLifecycle)-1 && *found.instance.State.Name != "terminated" {
+			found.step++
+			found.instance.State.Name = aws.String(self.InstanceLifecycle[found.step])
+			if found.step == len(self.InstanceLifecycle)-1 && self.StateReason != "" {
+				found.instance.StateReason = &ec2.StateReason{
+					Code:    aws.String(self.StateReason),
+					Message: aws.String(self.StateReason),
+				}
+			}
+		}
+		reservation.Instances = append(reservation.Instances, copyInstance(found.instance))
+	}
+	output := new(ec2.DescribeInstancesOutput)
+	output.NextToken = nextToken
+	if len(reservation.Instances) > 0 {
+		output.Reservations = []*ec2.Reservation{reservation}
+	}
+	return output, nil
+}
+
+func (self *FakeEc2) DescribeInstanceStatus(input *ec2.DescribeInstanceStatusInput) (*ec2.DescribeInstanceStatusOutput, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if err := self.record("DescribeInstanceStatus"); err != nil {
+		return nil, err
+	}
+	output := new(ec2.DescribeInstanceStatusOutput)
+	for _, id := range input.InstanceIds {
+		found, ok := self.instances[*id]
+		if !ok || *found.instance.State.Name != "running" {
+			continue
+		}
+		output.InstanceStatuses = append(output.InstanceStatuses, &ec2.InstanceStatus{
+			InstanceId:     aws.String(*id),
+			InstanceState:  &ec2.InstanceState{Name: aws.String("running")},
+			InstanceStatus: &ec2.InstanceStatusSummary{Status: aws.String(self.InstanceStatus)},
+			SystemStatus:   &ec2.InstanceStatusSummary{Status: aws.String("ok")},
+		})
+	}
+	return output, nil
+}
+
+func (self *FakeEc2) GetConsoleOutput(input *ec2.GetConsoleOutputInput) (*ec2.GetConsoleOutputOutput, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if err := self.record("GetConsoleOutput"); err != nil {
+		return nil, err
+	}
+	id := aws.StringValue(input.InstanceId)
+	if _, ok := self.instances[id]; !ok {
+		return nil, awserr.New("InvalidInstanceID.NotFound",
+			fmt.Sprintf("The instance ID '%v' does not exist", id), nil)
+	}
+	if aws.BoolValue(input.Latest) && !self.LatestConsole {
+		return nil, awserr.New("UnsupportedOperation",
+			"The latest console output is only available on Nitro instances", nil)
+	}
+	output := new(ec2.GetConsoleOutputOutput)
+	output.InstanceId = aws.String(id)
+	output.Output = aws.String(base64.StdEncoding.EncodeToString([]byte(self.ConsoleOutput)))
+	output.Timestamp = aws.Time(self.now())
+	return output, nil
+}
+
+func (self *FakeEc2) CreateTags(input *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if err := self.record("CreateTags"); err != nil {
+		return nil, err
+	}
+	for _, resource := range input.Resources {
+		if found, ok := self.instances[*resource]; ok {
+			found.instance.Tags = mergeTags(found.instance.Tags, input.Tags)
+		} else if found, ok := self.images[*resource]; ok {
+			found.image.Tags = mergeTags(found.image.Tags, input.Tags)
+		} else {
+			return nil, awserr.New("InvalidID",
+				fmt.Sprintf("The ID '%v' is not valid", *resource), nil)
+		}
+	}
+	return &ec2.CreateTagsOutput{}, nil
+}
+
+// DeleteTags removes the given tag keys, whatever their value, as EC2 does
+// for tags without a value.
+func (self *FakeEc2) DeleteTags(input *ec2.DeleteTagsInput) (*ec2.DeleteTagsOutput, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if err := self.record("DeleteTags"); err != nil {
+		return nil, err
+	}
+	for _, resource := range input.Resources {
+		if found, ok := self.instances[*resource]; ok {
+			found.instance.Tags = removeTags(found.instance.Tags, input.Tags)
+		} else if found, ok := self.images[*resource]; ok {
+			found.image.Tags = removeTags(found.image.Tags, input.Tags)
+		} else {
+			return nil, awserr.New("InvalidID",
+				fmt.Sprintf("The ID '%v' is not valid", *resource), nil)
+		}
+	}
+	return &ec2.DeleteTagsOutput{}, nil
+}
+
+func (self *FakeEc2) CreateImage(input *ec2.CreateImageInput) (*ec2.CreateImageOutput, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if err := self.record("CreateImage"); err != nil {
+		return nil, err
+	}
+	_, ok := self.instances[aws.StringValue(input.InstanceId)]
+	if !ok {
+		return nil, awserr.New("InvalidInstanceID.NotFound",
+			fmt.Sprintf("The instance ID '%v' does not exist", aws.StringValue(input.InstanceId)), nil)
+	}
+	image := new(ec2.Image)
+	image.ImageId = aws.String(self.nextId("ami"))
+	image.Name = aws.String(aws.StringValue(input.Name))
+	image.Description = aws.String(aws.StringValue(input.Description))
+	image.Architecture = aws.String("x86_64")
+	image.CreationDate = aws.String(self.now().Format("2006-01-02T15:04:05.000Z"))
+	image.OwnerId = aws.String(self.OwnerId)
+	image.State = aws.String(self.ImageLifecycle[0])
+	image.RootDeviceName = aws.String("/dev/sda1")
+	image.RootDeviceType = aws.String("ebs")
+	image.VirtualizationType = aws.String("hvm")
+	image.EnaSupport = aws.Bool(true)
+	snapshotId := self.nextId("snap")
+	self.snapshots[snapshotId] = 8
+	image.BlockDeviceMappings = []*ec2.BlockDeviceMapping{{
+		DeviceName: aws.String("/dev/sda1"),
+		Ebs: &ec2.EbsBlockDevice{
+			SnapshotId:          aws.String(snapshotId),
+			VolumeSize:          aws.Int64(8),
+			VolumeType:          aws.String("gp2"),
+			DeleteOnTermination: aws.Bool(true),
+		},
+	}}
+	self.images[*image.ImageId] = &fakeImage{image: image}
+	return &ec2.CreateImageOutput{ImageId: aws.String(*image.ImageId)}, nil
+}
+
+func (self *FakeEc2) DescribeImages(input *ec2.DescribeImagesInput) (*ec2.DescribeImagesOutput, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if err := self.record("DescribeImages"); err != nil {
+		return nil, err
+	}
+	matches := make([]string, 0)
+	for id, found := range self.images {
+		if len(input.ImageIds) > 0 && !containsString(input.ImageIds, id) {
+			continue
+		}
+		if len(input.Owners) > 0 && !containsString(input.Owners, aws.StringValue(found.image.OwnerId)) {
+			continue
+		}
+		if !matchFilters(input.Filters, found.image.Tags) {
+			continue
+		}
+		if !matchSnapshotFilters(input.Filters, found.image) {
+			continue
+		}
+		matches = append(matches, id)
+	}
+	page, nextToken, err := self.paginate(matches, input.NextToken, input.MaxResults)
+	if err != nil {
+		return nil, err
+	}
+	output := new(ec2.DescribeImagesOutput)
+	output.NextToken = nextToken
+	for _, id := range page {
+		found := self.images[id]
+		if found.step < len(self.ImageLifecycle)-1 {
+			found.step++
+			found.image.State = aws.String(self.ImageLifecycle[found.step])
+		}
+		output.Images = append(output.Images, copyImage(found.image))
+	}
+	return output, nil
+}
+
+// DescribeLaunchTemplateVersions returns the seeded versions of the given
+// launch template, or of every one, matching Versions ("$Default", "$Latest"
+// or a number) and the "image-id" filter. Paging is not supported.
+func (self *FakeEc2) DescribeLaunchTemplateVersions(
+	input *ec2.DescribeLaunchTemplateVersionsInput) (*ec2.DescribeLaunchTemplateVersionsOutput, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if err := self.record("DescribeLaunchTemplateVersions"); err != nil {
+		return nil, err
+	}
+	latest := make(map[string]int64)
+	for _, version := range self.templates {
+		id := aws.StringValue(version.LaunchTemplateId)
+		if number := aws.Int64Value(version.VersionNumber); number > latest[id] {
+			latest[id] = number
+		}
+	}
+	output := new(ec2.DescribeLaunchTemplateVersionsOutput)
+	for _, version := range self.templates {
+		id := aws.StringValue(version.LaunchTemplateId)
+		if input.LaunchTemplateId != nil && aws.StringValue(input.LaunchTemplateId) != id {
+			continue
+		}
+		if input.LaunchTemplateName != nil &&
+			aws.StringValue(input.LaunchTemplateName) != aws.StringValue(version.LaunchTemplateName) {
+			continue
+		}
+		if len(input.Versions) > 0 {
+			number := aws.Int64Value(version.VersionNumber)
+			matched := false
+			for _, wanted := range aws.StringValueSlice(input.Versions) {
+				switch wanted {
+				case "$Default":
+					matched = matched || aws.BoolValue(version.DefaultVersion)
+				case "$Latest":
+					matched = matched || number == latest[id]
+				default:
+					matched = matched || wanted == fmt.Sprint(number)
+				}
+			}
+			if !matched {
+				continue
+			}
+		}
+		if !matchValueFilter(input.Filters, "image-id", aws.StringValue(version.LaunchTemplateData.ImageId)) {
+			continue
+		}
+		found := *version
+		output.LaunchTemplateVersions = append(output.LaunchTemplateVersions, &found)
+	}
+	return output, nil
+}
+
+func (self *FakeEc2) DeregisterImage(input *ec2.DeregisterImageInput) (*ec2.DeregisterImageOutput, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if err := self.record("DeregisterImage"); err != nil {
+		return nil, err
+	}
+	id := aws.StringValue(input.ImageId)
+	if _, ok := self.images[id]; !ok {
+		return nil, awserr.New("InvalidAMIID.NotFound",
+			fmt.Sprintf("The image id '[%v]' does not exist", id), nil)
+	}
+	delete(self.images, id)
+	return &ec2.DeregisterImageOutput{}, nil
+}
+
+func (self *FakeEc2) DeleteSnapshot(input *ec2.DeleteSnapshotInput) (*ec2.DeleteSnapshotOutput, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if err := self.record("DeleteSnapshot"); err != nil {
+		return nil, err
+	}
+	id := aws.StringValue(input.SnapshotId)
+	if _, ok := self.snapshots[id]; !ok {
+		return nil, awserr.New("InvalidSnapshot.NotFound",
+			fmt.Sprintf("The snapshot '%v' does not exist.", id), nil)
+	}
+	for imageId, found := range self.images {
+		if imageSnapshots(found.image)[id] {
+			return nil, awserr.New("InvalidSnapshot.InUse",
+				fmt.Sprintf("The snapshot %v is currently in use by %v", id, imageId), nil)
+		}
+	}
+	delete(self.snapshots, id)
+	return &ec2.DeleteSnapshotOutput{}, nil
+}
+
+func (self *FakeEc2) TerminateInstances(input *ec2.TerminateInstancesInput) (*ec2.TerminateInstancesOutput, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if err := self.record("TerminateInstances"); err != nil {
+		return nil, err
+	}
+	output := new(ec2.TerminateInstancesOutput)
+	for _, id := range input.InstanceIds {
+		found, ok := self.instances[*id]
+		if !ok {
+			return nil, awserr.New("InvalidInstanceID.NotFound",
+				fmt.Sprintf("The instance ID '%v' does not exist", *id), nil)
+		}
+		previous := *found.instance.State.Name
+		found.instance.State.Name = aws.String("terminated")
+		output.TerminatingInstances = append(output.TerminatingInstances, &ec2.InstanceStateChange{
+			InstanceId:    aws.String(*id),
+			PreviousState: &ec2.InstanceState{Name: aws.String(previous)},
+			CurrentState:  &ec2.InstanceState{Name: aws.String("terminated")},
+		})
+	}
+	return output, nil
+}
+
+func containsString(values []*string, value string) bool {
+	for _, v := range values {
+		if aws.StringValue(v) == value {
+			return true
+		}
+	}
+	return false
+}
+
+// matchFilters supports the "tag:<key>" filters built by this package.
+// Other filter names are ignored.
+func matchFilters(filters []*ec2.Filter, tags []*ec2.Tag) bool {
+	tagMap := make(map[string]string)
+	for _, tag := range tags {
+		tagMap[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	for _, filter := range filters {
+		name := aws.StringValue(filter.Name)
+		if !strings.HasPrefix(name, "tag:") {
+			continue
+		}
+		value, ok := tagMap[strings.TrimPrefix(name, "tag:")]
+		if !ok || !containsString(filter.Values, value) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchValueFilter tells if value is accepted by the filter called name, if
+// there is one.
+func matchValueFilter(filters []*ec2.Filter, name string, value string) bool {
+	for _, filter := range filters {
+		if aws.StringValue(filter.Name) == name && !containsString(filter.Values, value) {
+			return false
+		}
+	}
+	return true
+}
+
+func imageSnapshots(image *ec2.Image) map[string]bool {
+	snapshots := make(map[string]bool)
+	for _, mapping := range image.BlockDeviceMappings {
+		if mapping.Ebs != nil && mapping.Ebs.SnapshotId != nil {
+			snapshots[*mapping.Ebs.SnapshotId] = true
+		}
+	}
+	return snapshots
+}
+
+// matchSnapshotFilters supports the "block-device-mapping.snapshot-id" image
+// filter.
+func matchSnapshotFilters(filters []*ec2.Filter, image *ec2.Image) bool {
+	snapshots := imageSnapshots(image)
+	for _, filter := range filters {
+		if aws.StringValue(filter.Name) != "block-device-mapping.snapshot-id" {
+			continue
+		}
+		matched := false
+		for _, value := range filter.Values {
+			matched = matched || snapshots[aws.StringValue(value)]
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func mergeTags(existing []*ec2.Tag, added []*ec2.Tag) []*ec2.Tag {
+	for _, tag := range added {
+		replaced := false
+		for _, old := range existing {
+			if aws.StringValue(old.Key) == aws.StringValue(tag.Key) {
+				old.Value = aws.String(aws.StringValue(tag.Value))
+				replaced = true
+			}
+		}
+		if !replaced {
+			existing = append(existing, &ec2.Tag{
+				Key:   aws.String(aws.StringValue(tag.Key)),
+				Value: aws.String(aws.StringValue(tag.Value)),
+			})
+		}
+	}
+	return existing
+}
+
+func removeTags(existing []*ec2.Tag, removed []*ec2.Tag) []*ec2.Tag {
+	kept := make([]*ec2.Tag, 0)
+	for _, old := range existing {
+		matched := false
+		for _, tag := range removed {
+			if aws.StringValue(old.Key) == aws.StringValue(tag.Key) &&
+				(tag.Value == nil || aws.StringValue(old.Value) == aws.StringValue(tag.Value)) {
+				matched = true
+			}
+		}
+		if !matched {
+			kept = append(kept, old)
+		}
+	}
+	return kept
+}
+
+func copyTags(tags []*ec2.Tag) []*ec2.Tag {
+	return mergeTags(nil, tags)
+}
+
+func copyInstance(instance *ec2.Instance) *ec2.Instance {
+	newInstance := *instance
+	state := *instance.State
+	newInstance.State = &state
+	if instance.StateReason != nil {
+		reason := *instance.StateReason
+		newInstance.StateReason = &reason
+	}
+	newInstance.Tags = copyTags(instance.Tags)
+	return &newInstance
+}
+
+func copyImage(image *ec2.Image) *ec2.Image {
+	newImage := *image
+	newImage.Tags = copyTags(image.Tags)
+	return &newImage
+}
+
+// FakeAutoscaling is an in-memory AutoscalingClient holding launch
+// configurations and Auto Scaling groups.
+type FakeAutoscaling struct {
+	Errors         map[string]error
+	configurations []*autoscaling.LaunchConfiguration
+	groups         []*autoscaling.Group
+	calls          map[string]int
+	lock           sync.Mutex
+}
+
+func NewFakeAutoscaling() *FakeAutoscaling {
+	fake := FakeAutoscaling{}
+	fake.Errors = make(map[string]error)
+	fake.calls = make(map[string]int)
+	return &fake
+}
+
+// Factory returns an AutoscalingClientFactory handing out this fake for every
+// region.
+func (self *FakeAutoscaling) Factory() AutoscalingClientFactory {
+	return func(account *Account, region string) AutoscalingClient {
+		return self
+	}
+}
+
+// Calls returns how many times the given API operation has been invoked.
+func (self *FakeAutoscaling) Calls(operation string) int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.calls[operation]
+}
+
+// AddLaunchConfiguration seeds a launch configuration launching imageId.
+func (self *FakeAutoscaling) AddLaunchConfiguration(name string, imageId string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.configurations = append(self.configurations, &autoscaling.LaunchConfiguration{
+		LaunchConfigurationName: aws.String(name),
+		ImageId:                 aws.String(imageId),
+	})
+}
+
+// DescribeLaunchConfigurations returns every seeded launch configuration, or
+// only those named. Paging is not supported.
+func (self *FakeAutoscaling) DescribeLaunchConfigurations(
+	input *autoscaling.DescribeLaunchConfigurationsInput) (*autoscaling.DescribeLaunchConfigurationsOutput, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.calls["DescribeLaunchConfigurations"]++
+	if err := self.Errors["DescribeLaunchConfigurations"]; err != nil {
+		return nil, err
+	}
+	output := new(autoscaling.DescribeLaunchConfigurationsOutput)
+	for _, configuration := range self.configurations {
+		name := aws.StringValue(configuration.LaunchConfigurationName)
+		if len(input.LaunchConfigurationNames) > 0 && !containsString(input.LaunchConfigurationNames, name) {
+			continue
+		}
+		found := *configuration
+		output.LaunchConfigurations = append(output.LaunchConfigurations, &found)
+	}
+	return output, nil
+}
+
+// AddAutoScalingGroup seeds an Auto Scaling group.
+func (self *FakeAutoscaling) AddAutoScalingGroup(group *autoscaling.Group) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.groups = append(self.groups, group)
+}
+
+// DescribeAutoScalingGroups returns every seeded group, or only those named.
+// Paging is not supported.
+func (self *FakeAutoscaling) DescribeAutoScalingGroups(
+	input *autoscaling.DescribeAutoScalingGroupsInput) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.calls["DescribeAutoScalingGroups"]++
+	if err := self.Errors["DescribeAutoScalingGroups"]; err != nil {
+		return nil, err
+	}
+	output := new(autoscaling.DescribeAutoScalingGroupsOutput)
+	for _, group := range self.groups {
+		name := aws.StringValue(group.AutoScalingGroupName)
+		if len(input.AutoScalingGroupNames) > 0 && !containsString(input.AutoScalingGroupNames, name) {
+			continue
+		}
+		found := *group
+		output.AutoScalingGroups = append(output.AutoScalingGroups, &found)
+	}
+	return output, nil
+}
@@ -0,0 +1,192 @@
+package autorefresh
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Every builder and AMI is tagged with the project and the source it was
+// built for. Retention, cleanup and listing filter on these tags, so projects
+// sharing the same user tags never see each other's images.
+const TAG_MAINTAINED_BY = "__Maintained_By__"
+const TAG_PROJECT = "__AutoRefreshAmi_Project__"
+const TAG_SOURCE = "__AutoRefreshAmi_Source__"
+
+// identity names the image lineage built from the source: its descriptive
+// fields, so that a source moving on to a newer AMI ID keeps its retention
+// history, or the AMI ID when none is set.
+func (self *Source) identity() string {
+	fields := make([]string, 0)
+	for _, value := range []string{self.Name, self.OS, self.Version, self.Architecture, self.Type} {
+		if value != "" {
+			fields = append(fields, value)
+		}
+	}
+	if len(fields) == 0 {
+		return self.AmiId
+	}
+	return strings.Join(fields, "/")
+}
+
+// setIdentity stamps the launch tags with the project and source identity.
+func (self *LaunchConfig) setIdentity(project string) {
+	if self.Tags == nil {
+		self.Tags = make(map[string]string)
+	}
+	self.Tags[TAG_PROJECT] = project
+	self.Tags[TAG_SOURCE] = self.Source.identity()
+}
+
+// retentionJobs returns one job of project per region and source identity,
+// the scope retention applies to.
+func (self *ConfigStorage) retentionJobs(project *Project) ([]AutoRefreshAmi, error) {
+	jobs, err := self.projectJobs(project)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	selected := make([]AutoRefreshAmi, 0)
+	for _, job := range jobs {
+		scope := fmt.Sprintf("%v %v", job.LaunchConfig.Source.Region, job.LaunchConfig.Tags[TAG_SOURCE])
+		if seen[scope] {
+			continue
+		}
+		seen[scope] = true
+		selected = append(selected, job)
+	}
+	return selected, nil
+}
+
+// legacyAmi returns the AMIs of the job created before identity tags were
+// introduced: they carry the project tags and are named after the project,
+// but have no project identity.
+func (self *AutoRefreshAmi) legacyAmi() ([]*AutoAmi, error) {
+	connection, err := self.Account.ConnectToRegion(self.LaunchConfig.Source.Region)
+	if err != nil {
+		return nil, err
+	}
+	ami := AutoAmi{}
+	ami.Connection = connection
+	ami.Region = self.LaunchConfig.Source.Region
+	ami.Tags = CopyMap(&self.LaunchConfig.Tags)
+	delete(ami.Tags, TAG_PROJECT)
+	delete(ami.Tags, TAG_SOURCE)
+	images, err := ami.findAmi(self.Account.OwnerId)
+	if err != nil {
+		return nil, err
+	}
+	legacy := make([]*AutoAmi, 0)
+	for _, image := range images {
+		if _, ok := image.Tags[TAG_PROJECT]; ok {
+			continue
+		}
+		if !strings.HasPrefix(image.Name, self.Name+" ") {
+			continue
+		}
+		if _, err := time.Parse(AMI_NAME_TIME_FORMAT, strings.TrimPrefix(image.Name, self.Name+" ")); err != nil {
+			continue
+		}
+		image.Connection = connection
+		legacy = append(legacy, image)
+	}
+	return legacy, nil
+}
+
+// legacyInstances returns the builders launched before identity tags were
+// introduced. They only carry the project tags, so like before the upgrade
+// they include the builders of projects sharing the same tags.
+func (self *AutoRefreshAmi) legacyInstances() ([]AutoInstance, error) {
+	config := self.LaunchConfig
+	config.Tags = CopyMap(&self.LaunchConfig.Tags)
+	delete(config.Tags, TAG_PROJECT)
+	delete(config.Tags, TAG_SOURCE)
+	instances, err := self.Account.FindInstances(&config)
+	if err != nil {
+		return nil, err
+	}
+	legacy := make([]AutoInstance, 0)
+	for _, instance := range *instances {
+		if _, ok := instance.Tags[TAG_PROJECT]; ok {
+			continue
+		}
+		legacy = append(legacy, instance)
+	}
+	return legacy, nil
+}
+
+// MigrateAmis adds the identity tags to the AMIs created by older versions
+// for every project, or only the named one, bringing them under retention
+// again. Images are only claimed for a region where the project has a single
+// source identity; others are reported and left alone. With dryRun set
+// nothing is tagged.
+func (self *ConfigStorage) MigrateAmis(ctx context.Context, name string, dryRun bool) (AmiInventory, error) {
+	migrated := make(AmiInventory, 0)
+	failures := make(ErrorList, 0)
+	found := false
+	for _, project := range self.sortedProjects() {
+		if name != "" && project.Name != name {
+			continue
+		}
+		found = true
+		jobs, err := self.retentionJobs(project)
+		if err != nil {
+			failures = append(failures, err)
+			continue
+		}
+		regions := make(map[string]int)
+		for _, job := range jobs {
+			regions[job.LaunchConfig.Source.Region]++
+		}
+		for index := range jobs {
+			job := &jobs[index]
+			job.resetLogFields()
+			if err := ctx.Err(); err != nil {
+				return migrated, append(failures, job.wrapError(RetentionError, "MigrateAmis", err))
+			}
+			images, err := job.legacyAmi()
+			if err != nil {
+				failures = append(failures, job.wrapError(RetentionError, "DescribeImages", err))
+				continue
+			}
+			if len(images) > 0 && regions[job.LaunchConfig.Source.Region] > 1 {
+				err := fmt.Errorf("%v AMIs without identity tags are ambiguous, Project has %v sources in the region",
+					len(images), regions[job.LaunchConfig.Source.Region])
+				failures = append(failures, job.wrapError(RetentionError, "MigrateAmis", err))
+				continue
+			}
+			for _, image := range images {
+				if !dryRun {
+					image.Tags = map[string]string{
+						TAG_PROJECT: job.LaunchConfig.Tags[TAG_PROJECT],
+						TAG_SOURCE:  job.LaunchConfig.Tags[TAG_SOURCE],
+					}
+					if err := image.TagImage(); err != nil {
+						failures = append(failures, job.wrapError(RetentionError, "TagImage", err))
+						continue
+					}
+				}
+				log.WithFields(job.logFields).Infof("Identity tags added to AMI: %v, dry run: %v", image.Id, dryRun)
+				migrated = append(migrated, ManagedAmi{
+					Project:      job.Name,
+					Account:      job.Account.Name,
+					Region:       job.LaunchConfig.Source.Region,
+					Id:           image.Id,
+					Name:         image.Name,
+					CreationDate: image.CreationDate,
+					State:        image.State,
+					Retention:    job.Retention.String(),
+				})
+			}
+		}
+	}
+	if !found {
+		return nil, &Error{Kind: ConfigError, Op: "MigrateAmis", Project: name,
+			Err: fmt.Errorf("Project '%v' is not defined", name)}
+	}
+	if len(failures) > 0 {
+		return migrated, failures
+	}
+	return migrated, nil
+}
@@ -0,0 +1,202 @@
+package autorefresh
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// Projects web and api share their user tags and source, mixed has two
+// sources in us-east-1.
+const identityConfig = `[
+{"Account": {"Name": "a", "OwnerId": "111111111111"}},
+{"UserData": {"Name": "u", "Bash": "echo hello"}},
+{"Source": {"AmiId": "ami-ubuntu", "Region": "us-east-1", "Name": "ubuntu"}},
+{"Source": {"AmiId": "ami-debian", "Region": "us-east-1", "Name": "debian"}},
+{"Project": {"Name": "web", "Account": "a", "UserData": "u", "Cron": "@daily",
+    "SourceFilter": {"Name": "ubuntu"}, "Retention": {"KeepLast": 1}, "Tags": {"role": "app"}}},
+{"Project": {"Name": "api", "Account": "a", "UserData": "u", "Cron": "@daily",
+    "SourceFilter": {"Name": "ubuntu"}, "Retention": {"KeepLast": 1}, "Tags": {"role": "app"}}},
+{"Project": {"Name": "mixed", "Account": "a", "UserData": "u", "Cron": "@daily",
+    "SourceFilter": {"Region": "us-east-1"}, "Retention": {"KeepLast": 1}, "Tags": {"role": "mixed"}}}
+]`
+
+// newIdentityConfig loads identityConfig with account a served by fake.
+func newIdentityConfig(t *testing.T, fake *FakeEc2) *ConfigStorage {
+	directory := writeTestConfig(t, map[string]string{"config.json": identityConfig})
+	defer os.RemoveAll(directory)
+	cs := &ConfigStorage{}
+	if err := cs.ProcessDirectory(directory); err != nil {
+		t.Fatalf("ProcessDirectory failed: %v", err)
+	}
+	cs.accounts["a"].ClientFactory = fake.Factory()
+	cs.accounts["a"].AutoscalingFactory = NewFakeAutoscaling().Factory()
+	return cs
+}
+
+// identityJob returns the only job of the named project.
+func identityJob(t *testing.T, cs *ConfigStorage, name string) *AutoRefreshAmi {
+	jobs, err := cs.projectJobs(cs.projects[name])
+	if err != nil || len(jobs) != 1 {
+		t.Fatalf("Project %v: %v jobs, error %v", name, len(jobs), err)
+	}
+	return &jobs[0]
+}
+
+// legacyTags returns the tags of job as set before identity tags existed.
+func legacyTags(job *AutoRefreshAmi) map[string]string {
+	tags := CopyMap(&job.LaunchConfig.Tags)
+	delete(tags, TAG_PROJECT)
+	delete(tags, TAG_SOURCE)
+	return tags
+}
+
+func TestSetIdentity(t *testing.T) {
+	tests := []struct {
+		source   Source
+		tags     map[string]string
+		identity string
+	}{
+		{Source{AmiId: "ami-1", Name: "ubuntu", Version: "16.04"}, map[string]string{"role": "app"}, "ubuntu/16.04"},
+		{Source{AmiId: "ami-1", OS: "linux", Architecture: "x86_64", Type: "hvm"}, nil, "linux/x86_64/hvm"},
+		{Source{AmiId: "ami-1", Region: "us-east-1"}, nil, "ami-1"},
+	}
+	for _, test := range tests {
+		config := LaunchConfig{Source: test.source, Tags: CopyMap(&test.tags)}
+		config.setIdentity("web")
+		expected := CopyMap(&test.tags)
+		expected[TAG_PROJECT] = "web"
+		expected[TAG_SOURCE] = test.identity
+		if !reflect.DeepEqual(config.Tags, expected) {
+			t.Errorf("Source %+v tagged %v, expected %v", test.source, config.Tags, expected)
+		}
+	}
+}
+
+func TestFindInstances(t *testing.T) {
+	fake := NewFakeEc2("111111111111")
+	fake.PageSize = 1
+	cs := newIdentityConfig(t, fake)
+	web, api := identityJob(t, cs, "web"), identityJob(t, cs, "api")
+	expected := []string{
+		fake.AddInstance(&ec2.Instance{Tags: testTags(web.LaunchConfig.Tags)}),
+		fake.AddInstance(&ec2.Instance{Tags: testTags(web.LaunchConfig.Tags)}),
+	}
+	fake.AddInstance(&ec2.Instance{Tags: testTags(api.LaunchConfig.Tags)})
+	fake.AddInstance(&ec2.Instance{Tags: testTags(legacyTags(web))})
+
+	instances, err := web.Account.FindInstances(&web.LaunchConfig)
+	if err != nil {
+		t.Fatalf("FindInstances failed: %v", err)
+	}
+	found := make([]string, 0)
+	for _, instance := range *instances {
+		found = append(found, instance.Id)
+	}
+	sort.Strings(found)
+	sort.Strings(expected)
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("Found %v, expected %v", found, expected)
+	}
+}
+
+func TestPruneSharedTags(t *testing.T) {
+	fake := NewFakeEc2("111111111111")
+	cs := newIdentityConfig(t, fake)
+	created := time.Now().UTC().Add(-72 * time.Hour)
+	images := make(map[string][]string)
+	for _, name := range []string{"web", "api"} {
+		job := identityJob(t, cs, name)
+		for i := 0; i < 2; i++ {
+			images[name] = append(images[name], fake.AddImage(&ec2.Image{
+				CreationDate: aws.String(created.Add(time.Duration(i) * time.Hour).Format(time.RFC3339)),
+				Tags:         testTags(job.LaunchConfig.Tags),
+			}))
+		}
+	}
+
+	pruned, err := cs.PruneAmis(context.Background(), "web", false)
+	if err != nil {
+		t.Fatalf("PruneAmis failed: %v", err)
+	}
+	if len(pruned) != 1 || pruned[0].Id != images["web"][0] {
+		t.Errorf("Pruned %v, expected only %v", pruned, images["web"][0])
+	}
+	for _, id := range images["api"] {
+		if fake.Image(id) == nil {
+			t.Errorf("AMI %v of Project api deleted by Project web", id)
+		}
+	}
+}
+
+func TestMigrateAmis(t *testing.T) {
+	created := time.Now().UTC().Add(-72 * time.Hour)
+	name := func(project string) *string {
+		return aws.String(project + " " + created.Format(AMI_NAME_TIME_FORMAT))
+	}
+	tests := []struct {
+		project  string
+		dryRun   bool
+		migrated bool
+		failed   bool
+	}{
+		{"web", false, true, false},
+		{"web", true, false, false},
+		{"mixed", false, false, true},
+	}
+	for _, test := range tests {
+		fake := NewFakeEc2("111111111111")
+		cs := newIdentityConfig(t, fake)
+		web := identityJob(t, cs, "web")
+		legacy := fake.AddImage(&ec2.Image{Name: name("web"), Tags: testTags(legacyTags(web))})
+		mixedJobs, err := cs.projectJobs(cs.projects["mixed"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		mixedLegacy := fake.AddImage(&ec2.Image{Name: name("mixed"), Tags: testTags(legacyTags(&mixedJobs[0]))})
+		untouched := []string{
+			fake.AddImage(&ec2.Image{Name: name("web"), Tags: testTags(map[string]string{"role": "other"})}),
+			fake.AddImage(&ec2.Image{Name: aws.String("web nightly"), Tags: testTags(legacyTags(web))}),
+			fake.AddImage(&ec2.Image{Name: name("api"), Tags: testTags(legacyTags(web))}),
+			fake.AddImage(&ec2.Image{Name: name("web"), Tags: testTags(identityJob(t, cs, "api").LaunchConfig.Tags)}),
+		}
+
+		migrated, err := cs.MigrateAmis(context.Background(), test.project, test.dryRun)
+		if (err != nil) != test.failed {
+			t.Errorf("%v, dry run %v: unexpected error %v", test.project, test.dryRun, err)
+		}
+		expected := legacy
+		if test.project == "mixed" {
+			expected = mixedLegacy
+		}
+		if reported := len(migrated) == 1 && migrated[0].Id == expected; reported == test.failed {
+			t.Errorf("%v, dry run %v: migrated %v", test.project, test.dryRun, migrated)
+		}
+		if tagged := aws.StringValue(imageTag(fake.Image(expected), TAG_PROJECT)) == test.project; tagged != test.migrated {
+			t.Errorf("%v, dry run %v: AMI %v tagged %v", test.project, test.dryRun, expected, tagged)
+		}
+		if test.migrated && aws.StringValue(imageTag(fake.Image(legacy), TAG_SOURCE)) != web.LaunchConfig.Tags[TAG_SOURCE] {
+			t.Errorf("AMI %v tagged with source %v", legacy, fake.Image(legacy).Tags)
+		}
+		for _, id := range untouched {
+			if project := aws.StringValue(imageTag(fake.Image(id), TAG_PROJECT)); project == test.project {
+				t.Errorf("%v, dry run %v: AMI %v adopted", test.project, test.dryRun, id)
+			}
+		}
+	}
+}
+
+// imageTag returns the value of the tag key of image, or nil.
+func imageTag(image *ec2.Image, key string) *string {
+	for _, tag := range image.Tags {
+		if aws.StringValue(tag.Key) == key {
+			return tag.Value
+		}
+	}
+	return nil
+}
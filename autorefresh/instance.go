@@ -1,14 +1,20 @@
 package autorefresh
 
 import (
+	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"strings"
 	"time"
 )
 
+// AMIs are named "<project name> <creation time>", with the time in this format.
+const AMI_NAME_TIME_FORMAT = "02 Jan 06 15h04m05s MST"
+
 type LaunchConfig struct {
 	UserData     string
 	Source       Source
@@ -66,14 +72,35 @@ func (self *EbsVolume) Copy() EbsVolume {
 	return *self
 }
 
+// Instance states and state reason codes which mean the builder will never
+// reach a clean "stopped" state.
+var FAILED_STATES map[string]bool = map[string]bool{
+	"shutting-down": true,
+	"terminated":    true,
+}
+
+var FAILED_STATE_REASONS map[string]bool = map[string]bool{
+	"Client.InternalError":                true,
+	"Client.InvalidSnapshot.NotFound":     true,
+	"Client.VolumeLimitExceeded":          true,
+	"Server.InsufficientInstanceCapacity": true,
+	"Server.InternalError":                true,
+	"Server.ScheduledStop":                true,
+	"Server.SpotInstanceShutdown":         true,
+	"Server.SpotInstanceTermination":      true,
+}
+
 type AutoInstance struct {
-	Id         string
-	ImageId    string
-	LaunchTime time.Time
-	State      string
-	Tags       map[string]string
-	Region     string
-	Connection *ec2.EC2
+	Id                 string
+	ImageId            string
+	LaunchTime         time.Time
+	State              string
+	StateReasonCode    string
+	StateReasonMessage string
+	Tags               map[string]string
+	Region             string
+	Connection         Ec2Client
+	bufferedConsole    bool
 }
 
 func (self *AutoInstance) getLogFields() map[string]interface{} {
@@ -86,15 +113,27 @@ func (self *AutoInstance) getLogFields() map[string]interface{} {
 }
 
 func (self *AutoInstance) Update(instance *ec2.Instance) {
-	self.Id = *instance.InstanceId
-	self.LaunchTime = *instance.LaunchTime
-	self.ImageId = *instance.ImageId
-	self.State = *instance.State.Name
+	self.Id = aws.StringValue(instance.InstanceId)
+	self.LaunchTime = aws.TimeValue(instance.LaunchTime)
+	self.ImageId = aws.StringValue(instance.ImageId)
+	self.State = ""
+	if instance.State != nil {
+		self.State = aws.StringValue(instance.State.Name)
+	}
+	self.StateReasonCode = ""
+	self.StateReasonMessage = ""
+	if instance.StateReason != nil {
+		self.StateReasonCode = aws.StringValue(instance.StateReason.Code)
+		self.StateReasonMessage = aws.StringValue(instance.StateReason.Message)
+	}
 	if self.Tags == nil {
 		self.Tags = make(map[string]string)
 	}
 	for _, tag := range instance.Tags {
-		self.Tags[*tag.Key] = *tag.Value
+		if tag == nil || tag.Key == nil {
+			continue
+		}
+		self.Tags[*tag.Key] = aws.StringValue(tag.Value)
 	}
 }
 
@@ -126,6 +165,9 @@ func (self *AutoInstance) IsStopped() (bool, error) {
 		log.WithFields(self.getLogFields()).Error(err)
 		return false, err
 	}
+	if len(resp.Reservations) == 0 || len(resp.Reservations[0].Instances) == 0 {
+		return false, fmt.Errorf("Instance %v not found", self.Id)
+	}
 	instance := resp.Reservations[0].Instances[0]
 	self.Update(instance)
 	if self.State == "stopped" {
@@ -135,16 +177,62 @@ func (self *AutoInstance) IsStopped() (bool, error) {
 	}
 }
 
-func (self *AutoInstance) WaitForStoppedState() error {
+// checkFailure returns an *InstanceFailure if the builder ended up in a
+// state it can not recover from, or failed its status checks.
+func (self *AutoInstance) checkFailure() error {
+	if FAILED_STATES[self.State] || FAILED_STATE_REASONS[self.StateReasonCode] {
+		return self.newFailure("")
+	}
+	if self.State != "running" {
+		return nil
+	}
+	input := ec2.DescribeInstanceStatusInput{
+		InstanceIds: []*string{aws.String(self.Id)},
+	}
+	resp, err := self.Connection.DescribeInstanceStatus(&input)
+	if err != nil {
+		log.WithFields(self.getLogFields()).Warningf("Instance status API failed, message: %v", err)
+		return nil
+	}
+	for _, status := range resp.InstanceStatuses {
+		if status.SystemStatus != nil && aws.StringValue(status.SystemStatus.Status) == "impaired" {
+			return self.newFailure("system status check failed")
+		}
+		if status.InstanceStatus != nil && aws.StringValue(status.InstanceStatus.Status) == "impaired" {
+			return self.newFailure("instance status check failed")
+		}
+	}
+	return nil
+}
+
+func (self *AutoInstance) newFailure(statusCheck string) *InstanceFailure {
+	failure := InstanceFailure{
+		InstanceId:    self.Id,
+		State:         self.State,
+		ReasonCode:    self.StateReasonCode,
+		ReasonMessage: self.StateReasonMessage,
+		StatusCheck:   statusCheck,
+	}
+	return &failure
+}
+
+func (self *AutoInstance) WaitForStoppedState(ctx context.Context) error {
 	for self.State != "stopped" {
 		_, err := self.IsStopped()
 		if err != nil {
 			log.WithFields(self.getLogFields()).Error(err)
 			return err
 		}
+		if err := self.checkFailure(); err != nil {
+			log.WithFields(self.getLogFields()).Errorf("Builder failed, message: %v", err)
+			return err
+		}
 		if self.State != "stopped" {
 			log.WithFields(self.getLogFields()).Debug("Waiting for instance to stop")
-			time.Sleep(5 * time.Second)
+			if err := sleepWithContext(ctx, POLL_INTERVAL); err != nil {
+				log.WithFields(self.getLogFields()).Warningf("Stopped waiting for instance, message: %v", err)
+				return err
+			}
 		} else {
 			log.WithFields(self.getLogFields()).Info("Instance stopped")
 		}
@@ -152,12 +240,39 @@ func (self *AutoInstance) WaitForStoppedState() error {
 	return nil
 }
 
+// ConsoleOutput returns the decoded console output of the instance. The
+// latest output is requested, falling back to the buffered output on
+// hypervisors that only keep that.
+func (self *AutoInstance) ConsoleOutput() (string, error) {
+	input := ec2.GetConsoleOutputInput{
+		InstanceId: aws.String(self.Id),
+	}
+	if !self.bufferedConsole {
+		input.Latest = aws.Bool(true)
+	}
+	resp, err := self.Connection.GetConsoleOutput(&input)
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "UnsupportedOperation" && !self.bufferedConsole {
+		log.WithFields(self.getLogFields()).Debug("Latest console output not supported, using buffered output")
+		self.bufferedConsole = true
+		return self.ConsoleOutput()
+	}
+	if err != nil {
+		log.WithFields(self.getLogFields()).Errorf("Console output API failed, message: %v", err)
+		return "", err
+	}
+	output, err := base64.StdEncoding.DecodeString(aws.StringValue(resp.Output))
+	if err != nil {
+		return "", err
+	}
+	return string(output), nil
+}
+
 func (self *AutoInstance) CreateAmi(name string) (*AutoAmi, error) {
 	ami := AutoAmi{}
 	ami.Connection = self.Connection
 	ami.Region = self.Region
 	ami.Tags = self.Tags
-	time_now := time.Now().Format("02 Jan 06 15h04m05s MST")
+	time_now := time.Now().Format(AMI_NAME_TIME_FORMAT)
 	ami.Name = fmt.Sprintf("%v %v", name, time_now)
 
 	imageOptions := &ec2.CreateImageInput{
@@ -0,0 +1,53 @@
+package autorefresh
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"testing"
+)
+
+// failureCase is an instance state and reason, and the failure reason
+// expected from checkFailure, empty when the instance is healthy.
+type failureCase struct {
+	state          string
+	reasonCode     string
+	instanceStatus string
+	reason         string
+}
+
+func TestCheckFailure(t *testing.T) {
+	tests := []failureCase{
+		{"pending", "", "ok", ""},
+		{"running", "", "ok", ""},
+		{"running", "", "impaired", "instance status check failed"},
+		{"stopping", "Client.UserInitiatedShutdown", "ok", ""},
+		{"stopped", "Client.InstanceInitiatedShutdown", "ok", ""},
+	}
+	for state := range FAILED_STATES {
+		tests = append(tests, failureCase{state, "", "ok", "instance " + state})
+	}
+	for code := range FAILED_STATE_REASONS {
+		tests = append(tests, failureCase{"stopped", code, "ok", code})
+	}
+	for _, test := range tests {
+		fake := NewFakeEc2("111111111111")
+		fake.InstanceStatus = test.instanceStatus
+		id := fake.AddInstance(&ec2.Instance{State: &ec2.InstanceState{Name: aws.String(test.state)}})
+		instance := AutoInstance{Id: id, State: test.state, StateReasonCode: test.reasonCode, Connection: fake}
+		err := instance.checkFailure()
+		if test.reason == "" {
+			if err != nil {
+				t.Errorf("%v %v: unexpected failure %v", test.state, test.reasonCode, err)
+			}
+			continue
+		}
+		failure, ok := err.(*InstanceFailure)
+		if !ok {
+			t.Errorf("%v %v: expected an InstanceFailure, got %v", test.state, test.reasonCode, err)
+			continue
+		}
+		if failure.Reason() != test.reason {
+			t.Errorf("%v %v: reason %q, expected %q", test.state, test.reasonCode, failure.Reason(), test.reason)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package autorefresh
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// ManagedAmi is an AMI maintained for a project. Position counts from 1 for
+// the newest image; Retained is false for images the retention policy would
+// deregister; Retention describes the policy.
+type ManagedAmi struct {
+	Project      string
+	Account      string
+	Region       string
+	Id           string
+	Name         string
+	CreationDate string
+	State        string
+	Position     int
+	Retention    string
+	Retained     bool
+}
+
+// AmiInventory lists managed AMIs, by project and region, newest first.
+type AmiInventory []ManagedAmi
+
+// findAmi returns the AMIs maintained by the job in its source region,
+// newest first.
+func (self *AutoRefreshAmi) findAmi() ([]*AutoAmi, error) {
+	connection, err := self.Account.ConnectToRegion(self.LaunchConfig.Source.Region)
+	if err != nil {
+		return nil, err
+	}
+	ami := AutoAmi{}
+	ami.Connection = connection
+	ami.Region = self.LaunchConfig.Source.Region
+	ami.Tags = self.LaunchConfig.Tags
+	return ami.findAmi(self.Account.OwnerId)
+}
+
+// ListAmis returns the AMIs maintained for every project, or only for the
+// named one. Regions that cannot be queried are skipped and reported in the
+// returned ErrorList.
+func (self *ConfigStorage) ListAmis(name string) (AmiInventory, error) {
+	inventory := make(AmiInventory, 0)
+	failures := make(ErrorList, 0)
+	found := false
+	for _, project := range self.sortedProjects() {
+		if name != "" && project.Name != name {
+			continue
+		}
+		found = true
+		jobs, err := self.retentionJobs(project)
+		if err != nil {
+			failures = append(failures, err)
+			continue
+		}
+		for index := range jobs {
+			job := &jobs[index]
+			images, err := job.findAmi()
+			if err != nil {
+				failures = append(failures, job.wrapError(RetentionError, "DescribeImages", err))
+				continue
+			}
+			expired := make(map[string]bool)
+			for _, ami := range job.Retention.Expired(images, time.Now()) {
+				expired[ami.Id] = true
+			}
+			for position, ami := range images {
+				inventory = append(inventory, ManagedAmi{
+					Project:      job.Name,
+					Account:      job.Account.Name,
+					Region:       job.LaunchConfig.Source.Region,
+					Id:           ami.Id,
+					Name:         ami.Name,
+					CreationDate: ami.CreationDate,
+					State:        ami.State,
+					Position:     position + 1,
+					Retention:    job.Retention.String(),
+					Retained:     !expired[ami.Id],
+				})
+			}
+		}
+	}
+	if !found {
+		return nil, &Error{Kind: ConfigError, Op: "ListAmis", Project: name,
+			Err: fmt.Errorf("Project '%v' is not defined", name)}
+	}
+	if len(failures) > 0 {
+		return inventory, failures
+	}
+	return inventory, nil
+}
+
+var AMI_INVENTORY_COLUMNS = []string{
+	"Project", "Account", "Region", "Id", "Name", "CreationDate", "State", "Position", "Retention", "Retained",
+}
+
+func (self *ManagedAmi) columns() []string {
+	return []string{
+		self.Project,
+		self.Account,
+		self.Region,
+		self.Id,
+		self.Name,
+		self.CreationDate,
+		self.State,
+		strconv.Itoa(self.Position),
+		self.Retention,
+		strconv.FormatBool(self.Retained),
+	}
+}
+
+func (self AmiInventory) WriteText(w io.Writer) error {
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for index, column := range AMI_INVENTORY_COLUMNS {
+		if index > 0 {
+			fmt.Fprint(table, "\t")
+		}
+		fmt.Fprint(table, column)
+	}
+	fmt.Fprintln(table)
+	for _, ami := range self {
+		for index, column := range ami.columns() {
+			if index > 0 {
+				fmt.Fprint(table, "\t")
+			}
+			fmt.Fprint(table, column)
+		}
+		fmt.Fprintln(table)
+	}
+	return table.Flush()
+}
+
+func (self AmiInventory) WriteCsv(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	writer.Write(AMI_INVENTORY_COLUMNS)
+	for _, ami := range self {
+		writer.Write(ami.columns())
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func (self AmiInventory) WriteJson(w io.Writer) error {
+	b, err := json.MarshalIndent(self, "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(b))
+	return err
+}
@@ -0,0 +1,179 @@
+package autorefresh
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// configOrigin tells where a config entry was defined. Line is 0 when it could
+// not be located in the file.
+type configOrigin struct {
+	File string
+	Line int
+}
+
+func (self configOrigin) String() string {
+	if self.Line > 0 {
+		return fmt.Sprintf("%v:%v", self.File, self.Line)
+	}
+	return self.File
+}
+
+// configLines maps every top level config type key of a document to the lines
+// it appears on, one entry per occurrence in document order. An occurrence
+// holds several lines when its entries are defined apart, as in TOML arrays
+// of tables.
+type configLines map[string][][]int
+
+// next returns the lines of the next occurrence of configType.
+func (self configLines) next(configType string) []int {
+	occurrences := self[configType]
+	if len(occurrences) == 0 {
+		return nil
+	}
+	self[configType] = occurrences[1:]
+	return occurrences[0]
+}
+
+var CONFIG_LINE_FINDERS map[string]func([]byte) configLines = map[string]func([]byte) configLines{
+	".json": jsonConfigLines,
+	".yaml": yamlConfigLines,
+	".yml":  yamlConfigLines,
+	".toml": tomlConfigLines,
+}
+
+func lineAt(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+// fieldLine returns the first line from line on which the last key of the
+// field path is set, or line when none is found.
+func fieldLine(data []byte, line int, path string) int {
+	keys := strings.Split(path, ".")
+	key := strings.SplitN(keys[len(keys)-1], "[", 2)[0]
+	pattern := regexp.MustCompile(`(^|[\s{,-])["']?` + regexp.QuoteMeta(key) + `["']?\s*[:=]`)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for number := 1; scanner.Scan(); number++ {
+		if number >= line && pattern.MatchString(scanner.Text()) {
+			return number
+		}
+	}
+	return line
+}
+
+type jsonFrame struct {
+	object    bool
+	expectKey bool
+}
+
+// jsonConfigLines walks the JSON tokens and records the keys found at the top
+// level object, or in the objects of a top level list.
+func jsonConfigLines(data []byte) configLines {
+	lines := make(configLines)
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	stack := make([]*jsonFrame, 0)
+	typeDepth := 1
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return lines
+		}
+		if token == json.Delim('}') || token == json.Delim(']') {
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		var parent *jsonFrame
+		if len(stack) > 0 {
+			parent = stack[len(stack)-1]
+		}
+		if parent != nil && parent.object && parent.expectKey {
+			parent.expectKey = false
+			if key, ok := token.(string); ok && len(stack) == typeDepth {
+				lines[key] = append(lines[key], []int{lineAt(data, decoder.InputOffset())})
+			}
+			continue
+		}
+		if parent != nil && parent.object {
+			parent.expectKey = true
+		}
+		if token == json.Delim('{') || token == json.Delim('[') {
+			if len(stack) == 0 && token == json.Delim('[') {
+				typeDepth = 2
+			}
+			stack = append(stack, &jsonFrame{object: token == json.Delim('{'), expectKey: true})
+		}
+	}
+}
+
+var yamlKeyPattern = regexp.MustCompile(`^((?:\s*-)?\s*)["']?([A-Za-z0-9_]+)["']?\s*:(\s|$)`)
+
+// yamlConfigLines records the keys indented like the first key of each
+// document, which are the config types of a block style YAML document.
+func yamlConfigLines(data []byte) configLines {
+	lines := make(configLines)
+	typeColumn := -1
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for number := 1; scanner.Scan(); number++ {
+		if strings.HasPrefix(scanner.Text(), "---") {
+			typeColumn = -1
+			continue
+		}
+		match := yamlKeyPattern.FindStringSubmatch(scanner.Text())
+		if match == nil {
+			continue
+		}
+		if typeColumn < 0 {
+			typeColumn = len(match[1])
+		}
+		if len(match[1]) == typeColumn {
+			lines[match[2]] = append(lines[match[2]], []int{number})
+		}
+	}
+	return lines
+}
+
+var tomlTablePattern = regexp.MustCompile(`^\s*(\[\[?)\s*["']?([A-Za-z0-9_-]+)["']?\s*\]\]?\s*(#.*)?$`)
+var tomlKeyPattern = regexp.MustCompile(`^\s*["']?([A-Za-z0-9_-]+)["']?\s*=`)
+
+// tomlConfigLines records the top level tables, and the top level keys set
+// before the first table. All [[Type]] tables form a single occurrence since
+// the decoder returns them as one list.
+func tomlConfigLines(data []byte) configLines {
+	lines := make(configLines)
+	arrays := make(map[string]int)
+	inTable := false
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for number := 1; scanner.Scan(); number++ {
+		text := scanner.Text()
+		if match := tomlTablePattern.FindStringSubmatch(text); match != nil {
+			inTable = true
+			key := match[2]
+			if match[1] != "[[" {
+				lines[key] = append(lines[key], []int{number})
+				continue
+			}
+			if index, ok := arrays[key]; ok {
+				lines[key][index] = append(lines[key][index], number)
+				continue
+			}
+			arrays[key] = len(lines[key])
+			lines[key] = append(lines[key], []int{number})
+			continue
+		}
+		if strings.HasPrefix(strings.TrimSpace(text), "[") {
+			inTable = true
+			continue
+		}
+		if match := tomlKeyPattern.FindStringSubmatch(text); match != nil && !inTable {
+			lines[match[1]] = append(lines[match[1]], []int{number})
+		}
+	}
+	return lines
+}
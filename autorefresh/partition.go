@@ -0,0 +1,83 @@
+package autorefresh
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+const DEFAULT_PARTITION = endpoints.AwsPartitionID
+
+func findPartition(id string) (endpoints.Partition, bool) {
+	for _, partition := range endpoints.DefaultPartitions() {
+		if partition.ID() == id {
+			return partition, true
+		}
+	}
+	return endpoints.Partition{}, false
+}
+
+func (self *Account) validateEndpoint() error {
+	self.Partition = strings.ToLower(strings.TrimSpace(self.Partition))
+	self.Ec2Endpoint = strings.TrimSpace(self.Ec2Endpoint)
+	if self.Partition == "" {
+		self.Partition = DEFAULT_PARTITION
+	}
+	if _, ok := findPartition(self.Partition); !ok {
+		known := make([]string, 0)
+		for _, partition := range endpoints.DefaultPartitions() {
+			known = append(known, partition.ID())
+		}
+		return fmt.Errorf("Invalid Partition '%v' in Account '%v', expected one of: %v",
+			self.Partition, self.Name, strings.Join(known, ", "))
+	}
+	if self.Ec2Endpoint != "" {
+		endpoint, err := url.Parse(self.Ec2Endpoint)
+		if err != nil || endpoint.Scheme == "" || endpoint.Host == "" {
+			return fmt.Errorf("Invalid Ec2Endpoint '%v' in Account '%v'", self.Ec2Endpoint, self.Name)
+		}
+	}
+	return nil
+}
+
+// ValidateRegion checks that region belongs to the partition of the account.
+// Any region is accepted with Ec2Endpoint set, as emulators and regions newer
+// than the SDK are missing from its region table.
+func (self *Account) ValidateRegion(region string) error {
+	if region == "" {
+		return fmt.Errorf("Region missing, Account '%v' can not launch instances without one", self.Name)
+	}
+	if self.Ec2Endpoint != "" {
+		return nil
+	}
+	id := self.Partition
+	if id == "" {
+		id = DEFAULT_PARTITION
+	}
+	partition, ok := findPartition(id)
+	if !ok {
+		return fmt.Errorf("Unknown Partition '%v' in Account '%v'", id, self.Name)
+	}
+	if _, ok := partition.Regions()[region]; !ok {
+		regions := make([]string, 0)
+		for name := range partition.Regions() {
+			regions = append(regions, name)
+		}
+		sort.Strings(regions)
+		return fmt.Errorf("Region '%v' is not part of partition '%v' used by Account '%v' (regions: %v)",
+			region, id, self.Name, strings.Join(regions, ", "))
+	}
+	return nil
+}
+
+// ec2Config returns the per-client overrides for the EC2 API.
+func (self *Account) ec2Config() *aws.Config {
+	config := aws.NewConfig()
+	if self.Ec2Endpoint != "" {
+		config = config.WithEndpoint(self.Ec2Endpoint)
+	}
+	return config
+}
@@ -0,0 +1,30 @@
+package autorefresh
+
+import (
+	"testing"
+)
+
+func TestValidateRegion(t *testing.T) {
+	tests := []struct {
+		partition string
+		endpoint  string
+		region    string
+		valid     bool
+	}{
+		{"", "", "us-east-1", true},
+		{"aws", "", "eu-west-1", true},
+		{"aws", "", "cn-north-1", false},
+		{"aws-cn", "", "cn-north-1", true},
+		{"aws", "", "moon-central-1", false},
+		{"aws", "http://localhost:4566", "moon-central-1", true},
+		{"aws", "http://localhost:4566", "", false},
+		{"", "", "", false},
+	}
+	for _, test := range tests {
+		account := Account{Name: "test", Partition: test.partition, Ec2Endpoint: test.endpoint}
+		err := account.ValidateRegion(test.region)
+		if (err == nil) != test.valid {
+			t.Errorf("%v %v %q: unexpected error %v", test.partition, test.endpoint, test.region, err)
+		}
+	}
+}
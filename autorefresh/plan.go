@@ -0,0 +1,266 @@
+package autorefresh
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/robfig/cron"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PLAN_NEXT_RUNS is the number of upcoming cron runs shown by a plan.
+const PLAN_NEXT_RUNS = 3
+
+// PlannedAmi is an existing AMI as shown in a plan. InUseBy tells what keeps
+// an expired AMI from being deregistered.
+type PlannedAmi struct {
+	Id           string
+	Name         string
+	State        string
+	CreationDate string
+	InUseBy      []string
+}
+
+func newPlannedAmis(images []*AutoAmi) []PlannedAmi {
+	planned := make([]PlannedAmi, 0)
+	for _, ami := range images {
+		planned = append(planned, PlannedAmi{
+			Id:           ami.Id,
+			Name:         ami.Name,
+			State:        ami.State,
+			CreationDate: ami.CreationDate,
+		})
+	}
+	return planned
+}
+
+// SourcePlan lists the AMIs managed for one source of a project, those the
+// next successful refresh would deregister, and those it would keep past
+// their retention because they are still in use.
+type SourcePlan struct {
+	Source       Source
+	ExistingAmis []PlannedAmi
+	Deregister   []PlannedAmi
+	InUse        []PlannedAmi
+	Error        string
+}
+
+// ProjectPlan is what StartEngine would schedule for a project.
+type ProjectPlan struct {
+	Name           string
+	Account        string
+	OwnerId        string
+	UserData       string
+	InstanceType   string
+	RetentionCount uint
+	Retention      RetentionPolicy
+	KeepSnapshots  bool
+	EbsVolumes     []EbsVolume
+	Tags           map[string]string
+	Cron           string
+	NextRuns       []time.Time
+	PruneCron      string
+	NextPruneRuns  []time.Time
+	Sources        []SourcePlan
+	Error          string
+}
+
+// PlanReport is the outcome of ConfigStorage.Plan.
+type PlanReport struct {
+	ConfigPath  string
+	GeneratedAt time.Time
+	Projects    []ProjectPlan
+}
+
+// Failed tells if any part of the plan could not be worked out.
+func (self *PlanReport) Failed() bool {
+	for _, project := range self.Projects {
+		if project.Error != "" {
+			return true
+		}
+		for _, source := range project.Sources {
+			if source.Error != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// nextRuns returns the next count run times of a cron spec after now.
+func nextRuns(spec string, now time.Time, count int) ([]time.Time, error) {
+	runs := make([]time.Time, 0)
+	if spec == "" {
+		return runs, nil
+	}
+	schedule, err := cron.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < count; i++ {
+		now = schedule.Next(now)
+		if now.IsZero() {
+			break
+		}
+		runs = append(runs, now)
+	}
+	return runs, nil
+}
+
+// planRetention returns the AMIs managed by the job, those DeleteOldAmi
+// would deregister once a refresh succeeds at time now, and those it would
+// keep because they are still in use, along with what uses them. Only
+// read-only Describe* calls are made.
+func (self *AutoRefreshAmi) planRetention(now time.Time) (existing []*AutoAmi, deregister []*AutoAmi,
+	inUse []*AutoAmi, users map[string][]string, err error) {
+	connection, err := self.Account.ConnectToRegion(self.LaunchConfig.Source.Region)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	autoscaling, err := self.Account.ConnectToAutoscaling(self.LaunchConfig.Source.Region)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	ami := AutoAmi{}
+	ami.Connection = connection
+	ami.Autoscaling = autoscaling
+	ami.Region = self.LaunchConfig.Source.Region
+	ami.Tags = self.LaunchConfig.Tags
+	existing, err = ami.findAmi(self.Account.OwnerId)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	// The policy is applied once the image built by the refresh is available
+	next := AutoAmi{State: "available", CreationDate: now.UTC().Format(time.RFC3339)}
+	deregister, inUse, users, err = ami.expiredImages(append([]*AutoAmi{&next}, existing...), &self.Retention, now)
+	if err != nil {
+		return existing, nil, nil, nil, err
+	}
+	return existing, deregister, inUse, users, nil
+}
+
+// Plan reports what StartEngine would do with the loaded config, without
+// making any mutating EC2 call.
+func (self *ConfigStorage) Plan(path string, now time.Time) *PlanReport {
+	report := PlanReport{ConfigPath: path, GeneratedAt: now}
+	report.Projects = make([]ProjectPlan, 0)
+	for _, project := range self.sortedProjects() {
+		projectPlan := ProjectPlan{
+			Name:           project.Name,
+			Account:        project.Account,
+			UserData:       project.UserData,
+			InstanceType:   project.InstanceType,
+			RetentionCount: project.RetentionCount,
+			Retention:      project.Retention,
+			KeepSnapshots:  project.KeepSnapshots,
+			EbsVolumes:     project.EbsVolumes,
+			Tags:           project.Tags,
+			Cron:           project.Cron,
+			PruneCron:      project.PruneCron,
+			Sources:        make([]SourcePlan, 0),
+		}
+		if account, ok := self.accounts[project.Account]; ok {
+			projectPlan.OwnerId = account.OwnerId
+		}
+		runs, err := nextRuns(project.Cron, now, PLAN_NEXT_RUNS)
+		if err != nil {
+			projectPlan.Error = fmt.Sprintf("Invalid Cron '%v': %v", project.Cron, err)
+		}
+		projectPlan.NextRuns = runs
+		projectPlan.NextPruneRuns, _ = nextRuns(project.PruneCron, now, PLAN_NEXT_RUNS)
+		jobs, err := self.projectJobs(project)
+		if err != nil {
+			projectPlan.Error = err.Error()
+		}
+		for index := range jobs {
+			job := &jobs[index]
+			sourcePlan := SourcePlan{Source: job.LaunchConfig.Source}
+			existing, deregister, inUse, users, err := job.planRetention(now)
+			if err != nil {
+				sourcePlan.Error = err.Error()
+			}
+			sourcePlan.ExistingAmis = newPlannedAmis(existing)
+			sourcePlan.Deregister = newPlannedAmis(deregister)
+			sourcePlan.InUse = newPlannedAmis(inUse)
+			for i := range sourcePlan.InUse {
+				sourcePlan.InUse[i].InUseBy = users[sourcePlan.InUse[i].Id]
+			}
+			projectPlan.Sources = append(projectPlan.Sources, sourcePlan)
+		}
+		report.Projects = append(report.Projects, projectPlan)
+	}
+	return &report
+}
+
+func (self *PlanReport) WriteJson(w io.Writer) error {
+	b, err := json.MarshalIndent(self, "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(b))
+	return err
+}
+
+func (self *PlanReport) WriteText(w io.Writer) error {
+	lines := []string{fmt.Sprintf("Config: %v", self.ConfigPath)}
+	for _, project := range self.Projects {
+		lines = append(lines, fmt.Sprintf("Project: %v", project.Name))
+		if project.Error != "" {
+			lines = append(lines, fmt.Sprintf("    Error: %v", project.Error))
+		}
+		lines = append(lines, fmt.Sprintf("    Account: %v (owner %v), UserData: %v",
+			project.Account, project.OwnerId, project.UserData))
+		lines = append(lines, fmt.Sprintf("    InstanceType: %v, Retention: %v, KeepSnapshots: %v",
+			project.InstanceType, project.Retention, project.KeepSnapshots))
+		if project.Cron == "" {
+			lines = append(lines, "    Cron: none, runs once when the engine starts")
+		} else {
+			runs := make([]string, 0)
+			for _, run := range project.NextRuns {
+				runs = append(runs, run.Format(time.RFC3339))
+			}
+			lines = append(lines, fmt.Sprintf("    Cron: %v, next runs: %v", project.Cron, strings.Join(runs, ", ")))
+		}
+		if project.PruneCron != "" {
+			runs := make([]string, 0)
+			for _, run := range project.NextPruneRuns {
+				runs = append(runs, run.Format(time.RFC3339))
+			}
+			lines = append(lines, fmt.Sprintf("    PruneCron: %v, next runs: %v", project.PruneCron,
+				strings.Join(runs, ", ")))
+		}
+		for _, ebs := range project.EbsVolumes {
+			lines = append(lines, fmt.Sprintf("    Ebs: %v %vGiB %v, DeleteOnTermination: %v",
+				ebs.DeviceName, ebs.VolumeSize, ebs.VolumeType, ebs.DeleteOnTermination))
+		}
+		tags := make([]string, 0)
+		for key, value := range project.Tags {
+			tags = append(tags, fmt.Sprintf("%v=%v", key, value))
+		}
+		sort.Strings(tags)
+		lines = append(lines, fmt.Sprintf("    Tags: %v", strings.Join(tags, ", ")))
+		for _, source := range project.Sources {
+			lines = append(lines, fmt.Sprintf("    Source: %v %v", source.Source.AmiId, source.Source.Region))
+			if source.Error != "" {
+				lines = append(lines, fmt.Sprintf("        Error: %v", source.Error))
+				continue
+			}
+			lines = append(lines, fmt.Sprintf("        Managed AMIs: %v, deregistered after the next refresh: %v",
+				len(source.ExistingAmis), len(source.Deregister)))
+			for _, ami := range source.Deregister {
+				lines = append(lines, fmt.Sprintf("            %v %v (%v)", ami.Id, ami.Name, ami.CreationDate))
+			}
+			if len(source.InUse) > 0 {
+				lines = append(lines, fmt.Sprintf("        Kept while in use: %v", len(source.InUse)))
+			}
+			for _, ami := range source.InUse {
+				lines = append(lines, fmt.Sprintf("            %v %v (%v), in use by %v", ami.Id, ami.Name,
+					ami.CreationDate, strings.Join(ami.InUseBy, ", ")))
+			}
+		}
+	}
+	_, err := fmt.Fprintln(w, strings.Join(lines, "\n"))
+	return err
+}
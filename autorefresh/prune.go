@@ -0,0 +1,103 @@
+package autorefresh
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Prune applies the retention policy of the job to the AMIs of its source
+// region, without building anything. With dryRun set it only returns the
+// AMIs it would deregister. When some deregistrations fail, the AMIs
+// deregistered are returned along with the error.
+func (self *AutoRefreshAmi) Prune(ctx context.Context, dryRun bool) ([]*AutoAmi, error) {
+	self.resetLogFields()
+	if err := ctx.Err(); err != nil {
+		return nil, self.wrapError(RetentionError, "Prune", err)
+	}
+	connection, err := self.Account.ConnectToRegion(self.LaunchConfig.Source.Region)
+	if err != nil {
+		return nil, self.fail(RetentionError, "ConnectToRegion", err)
+	}
+	autoscaling, err := self.Account.ConnectToAutoscaling(self.LaunchConfig.Source.Region)
+	if err != nil {
+		return nil, self.fail(RetentionError, "ConnectToAutoscaling", err)
+	}
+	ami := AutoAmi{}
+	ami.Connection = connection
+	ami.Autoscaling = autoscaling
+	ami.Region = self.LaunchConfig.Source.Region
+	ami.Tags = self.LaunchConfig.Tags
+	if !dryRun {
+		deleted, err := ami.DeleteOldAmi(self.Account.OwnerId, &self.Retention, !self.KeepSnapshots)
+		if err != nil {
+			return deleted, self.fail(RetentionError, "DeleteOldAmi", err)
+		}
+		return deleted, nil
+	}
+	images, err := ami.findAmi(self.Account.OwnerId)
+	if err != nil {
+		return nil, self.fail(RetentionError, "DescribeImages", err)
+	}
+	selected, inUse, users, err := ami.expiredImages(images, &self.Retention, time.Now())
+	if err != nil {
+		return nil, self.fail(RetentionError, "ImagesInUse", err)
+	}
+	for _, image := range inUse {
+		log.WithFields(self.logFields).Infof("Dry run, AMI %v kept, still in use by %v",
+			image.Id, strings.Join(users[image.Id], ", "))
+	}
+	for _, image := range selected {
+		log.WithFields(self.logFields).Infof("Dry run, would delete AMI: %v", image.Id)
+	}
+	return selected, nil
+}
+
+// PruneAmis applies retention to the AMIs of every project, or only of the
+// named one, and returns the AMIs deregistered, or only selected with dryRun.
+// Regions that fail, and AMIs that could not be deregistered, are reported in
+// the returned ErrorList.
+func (self *ConfigStorage) PruneAmis(ctx context.Context, name string, dryRun bool) (AmiInventory, error) {
+	pruned := make(AmiInventory, 0)
+	failures := make(ErrorList, 0)
+	found := false
+	for _, project := range self.sortedProjects() {
+		if name != "" && project.Name != name {
+			continue
+		}
+		found = true
+		jobs, err := self.retentionJobs(project)
+		if err != nil {
+			failures = append(failures, err)
+			continue
+		}
+		for index := range jobs {
+			job := &jobs[index]
+			images, err := job.Prune(ctx, dryRun)
+			if err != nil {
+				failures = append(failures, err)
+			}
+			for _, ami := range images {
+				pruned = append(pruned, ManagedAmi{
+					Project:      job.Name,
+					Account:      job.Account.Name,
+					Region:       job.LaunchConfig.Source.Region,
+					Id:           ami.Id,
+					Name:         ami.Name,
+					CreationDate: ami.CreationDate,
+					State:        ami.State,
+					Retention:    job.Retention.String(),
+				})
+			}
+		}
+	}
+	if !found {
+		return nil, &Error{Kind: ConfigError, Op: "PruneAmis", Project: name,
+			Err: fmt.Errorf("Project '%v' is not defined", name)}
+	}
+	if len(failures) > 0 {
+		return pruned, failures
+	}
+	return pruned, nil
+}
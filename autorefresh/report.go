@@ -0,0 +1,149 @@
+package autorefresh
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// ReportMessage is one error or warning of a ValidationReport.
+type ReportMessage struct {
+	Op      string
+	File    string
+	Line    int
+	Message string
+}
+
+func newReportMessage(err error) ReportMessage {
+	e, ok := err.(*Error)
+	if !ok {
+		return ReportMessage{Message: err.Error()}
+	}
+	message := ReportMessage{Op: e.Op, File: e.File, Line: e.Line}
+	if e.Err != nil {
+		message.Message = e.Err.Error()
+	}
+	return message
+}
+
+func (self *ReportMessage) String() string {
+	location := configOrigin{File: self.File, Line: self.Line}.String()
+	if location == "" {
+		return fmt.Sprintf("[%v] %v", self.Op, self.Message)
+	}
+	return fmt.Sprintf("%v: [%v] %v", location, self.Op, self.Message)
+}
+
+// ProjectReport tells which sources a project resolves to.
+type ProjectReport struct {
+	Name     string
+	File     string
+	Line     int
+	Account  string
+	UserData string
+	Cron     string
+	Sources  []Source
+}
+
+// ValidationReport is the outcome of loading a config directory.
+type ValidationReport struct {
+	ConfigPath string
+	Valid      bool
+	Errors     []ReportMessage
+	Warnings   []ReportMessage
+	Projects   []ProjectReport
+}
+
+// Report describes what ProcessDirectory loaded from path.
+func (self *ConfigStorage) Report(path string) *ValidationReport {
+	report := ValidationReport{ConfigPath: path, Valid: len(self.errors) == 0}
+	report.Errors = make([]ReportMessage, 0)
+	report.Warnings = make([]ReportMessage, 0)
+	report.Projects = make([]ProjectReport, 0)
+	for _, err := range self.errors {
+		report.Errors = append(report.Errors, newReportMessage(err))
+	}
+	for _, err := range self.warnings {
+		report.Warnings = append(report.Warnings, newReportMessage(err))
+	}
+	for _, project := range self.sortedProjects() {
+		projectReport := ProjectReport{
+			Name:     project.Name,
+			File:     project.origin.File,
+			Line:     project.origin.Line,
+			Account:  project.Account,
+			UserData: project.UserData,
+			Cron:     project.Cron,
+			Sources:  make([]Source, 0),
+		}
+		for _, source := range project.SourceFilter.findSources(&self.sources) {
+			projectReport.Sources = append(projectReport.Sources, source.Copy())
+		}
+		report.Projects = append(report.Projects, projectReport)
+	}
+	return &report
+}
+
+func (self *ConfigStorage) sortedProjects() []*Project {
+	names := make([]string, 0)
+	for name := range self.projects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	projects := make([]*Project, 0)
+	for _, name := range names {
+		projects = append(projects, self.projects[name])
+	}
+	return projects
+}
+
+func (self *ValidationReport) WriteJson(w io.Writer) error {
+	b, err := json.MarshalIndent(self, "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(b))
+	return err
+}
+
+func (self *ValidationReport) WriteText(w io.Writer) error {
+	lines := []string{fmt.Sprintf("Config: %v", self.ConfigPath)}
+	lines = append(lines, fmt.Sprintf("Errors: %v", len(self.Errors)))
+	for _, message := range self.Errors {
+		lines = append(lines, fmt.Sprintf("    %v", message.String()))
+	}
+	lines = append(lines, fmt.Sprintf("Warnings: %v", len(self.Warnings)))
+	for _, message := range self.Warnings {
+		lines = append(lines, fmt.Sprintf("    %v", message.String()))
+	}
+	lines = append(lines, fmt.Sprintf("Projects: %v", len(self.Projects)))
+	for _, project := range self.Projects {
+		location := configOrigin{File: project.File, Line: project.Line}
+		lines = append(lines, fmt.Sprintf("    %v (%v)", project.Name, location))
+		cron := project.Cron
+		if cron == "" {
+			cron = "none, runs once"
+		}
+		lines = append(lines, fmt.Sprintf("        Account: %v, UserData: %v, Cron: %v",
+			project.Account, project.UserData, cron))
+		for _, source := range project.Sources {
+			details := make([]string, 0)
+			for _, value := range []string{source.Name, source.OS, source.Version, source.Architecture, source.Type} {
+				if value != "" {
+					details = append(details, value)
+				}
+			}
+			lines = append(lines, fmt.Sprintf("        Source: %v %v %v", source.AmiId, source.Region,
+				strings.Join(details, " ")))
+		}
+	}
+	if self.Valid {
+		lines = append(lines, "Result: valid")
+	} else {
+		lines = append(lines, "Result: invalid")
+	}
+	_, err := fmt.Fprintln(w, strings.Join(lines, "\n"))
+	return err
+}
@@ -0,0 +1,159 @@
+package autorefresh
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetentionPolicy tells which AMIs of a project are kept. An image is kept
+// when any rule keeps it:
+//
+//	KeepLast        the newest available images
+//	KeepYoungerThan images younger than a duration, e.g. "36h", "14d" or "8w"
+//	KeepDaily       the newest image of each of the last days with an image
+//	KeepWeekly      the newest image of each of the last ISO weeks with an image
+//	KeepMonthly     the newest image of each of the last months with an image
+//
+// Days, weeks and months are taken in UTC. The newest available image is
+// always kept.
+type RetentionPolicy struct {
+	KeepLast        uint
+	KeepYoungerThan string
+	KeepDaily       uint
+	KeepWeekly      uint
+	KeepMonthly     uint
+	keepYoungerThan time.Duration
+}
+
+var RETENTION_AGE_PATTERN = regexp.MustCompile(`^([0-9]+)([dw])$`)
+
+// parseAge accepts time.ParseDuration values, and whole days or weeks.
+func parseAge(value string) (time.Duration, error) {
+	if match := RETENTION_AGE_PATTERN.FindStringSubmatch(value); match != nil {
+		count, err := strconv.Atoi(match[1])
+		if err != nil {
+			return 0, err
+		}
+		unit := 24 * time.Hour
+		if match[2] == "w" {
+			unit = 7 * unit
+		}
+		value = (time.Duration(count) * unit).String()
+	}
+	return parseTimeout(value)
+}
+
+// isEmpty tells if no rule is set.
+func (self *RetentionPolicy) isEmpty() bool {
+	return self.KeepLast == 0 && strings.TrimSpace(self.KeepYoungerThan) == "" &&
+		self.KeepDaily == 0 && self.KeepWeekly == 0 && self.KeepMonthly == 0
+}
+
+func (self *RetentionPolicy) validateAndSetDefaults() error {
+	self.KeepYoungerThan = strings.TrimSpace(self.KeepYoungerThan)
+	if self.KeepYoungerThan != "" {
+		age, err := parseAge(self.KeepYoungerThan)
+		if err != nil {
+			return fmt.Errorf("Invalid Retention.KeepYoungerThan: %v", err)
+		}
+		self.keepYoungerThan = age
+	}
+	return nil
+}
+
+func (self RetentionPolicy) String() string {
+	rules := make([]string, 0)
+	if self.KeepLast > 0 {
+		rules = append(rules, fmt.Sprintf("last %v", self.KeepLast))
+	}
+	if self.KeepYoungerThan != "" {
+		rules = append(rules, fmt.Sprintf("younger than %v", self.KeepYoungerThan))
+	}
+	if self.KeepDaily > 0 {
+		rules = append(rules, fmt.Sprintf("daily %v", self.KeepDaily))
+	}
+	if self.KeepWeekly > 0 {
+		rules = append(rules, fmt.Sprintf("weekly %v", self.KeepWeekly))
+	}
+	if self.KeepMonthly > 0 {
+		rules = append(rules, fmt.Sprintf("monthly %v", self.KeepMonthly))
+	}
+	return strings.Join(rules, ", ")
+}
+
+// keepPeriods keeps the newest image of each of the last count periods that
+// have an available image.
+func keepPeriods(amiFound []*AutoAmi, created []time.Time, count uint, period func(time.Time) string,
+	keep map[int]bool) {
+	seen := make(map[string]bool)
+	for i, ami := range amiFound {
+		if uint(len(seen)) >= count {
+			return
+		}
+		if ami.State != "available" || created[i].IsZero() {
+			continue
+		}
+		key := period(created[i])
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		keep[i] = true
+	}
+}
+
+// Expired picks, oldest first, the images of amiFound (sorted newest first)
+// the policy does not keep at time now. Images that are not available are
+// never picked, nor counted by KeepLast, which keeps the newest available
+// images. Images whose CreationDate cannot be parsed are never picked.
+func (self *RetentionPolicy) Expired(amiFound []*AutoAmi, now time.Time) []*AutoAmi {
+	keep := make(map[int]bool)
+	var kept uint
+	for i := 0; i < len(amiFound) && kept < self.KeepLast; i++ {
+		if amiFound[i].State == "available" {
+			keep[i] = true
+			kept++
+		}
+	}
+
+	created := make([]time.Time, len(amiFound))
+	for i, ami := range amiFound {
+		date, err := time.Parse(time.RFC3339, ami.CreationDate)
+		if err != nil {
+			keep[i] = true
+			continue
+		}
+		created[i] = date.UTC()
+		if self.keepYoungerThan > 0 && now.Sub(date) < self.keepYoungerThan {
+			keep[i] = true
+		}
+	}
+	keepPeriods(amiFound, created, self.KeepDaily, func(date time.Time) string {
+		return date.Format("2006-01-02")
+	}, keep)
+	keepPeriods(amiFound, created, self.KeepWeekly, func(date time.Time) string {
+		year, week := date.ISOWeek()
+		return fmt.Sprintf("%v-W%v", year, week)
+	}, keep)
+	keepPeriods(amiFound, created, self.KeepMonthly, func(date time.Time) string {
+		return date.Format("2006-01")
+	}, keep)
+	for i, ami := range amiFound {
+		if ami.State == "available" {
+			keep[i] = true
+			break
+		}
+	}
+
+	expired := make([]*AutoAmi, 0)
+	for i := len(amiFound) - 1; i >= 0; i-- {
+		if amiFound[i].State != "available" || keep[i] {
+			continue
+		}
+		expired = append(expired, amiFound[i])
+	}
+	return expired
+}
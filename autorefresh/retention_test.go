@@ -0,0 +1,234 @@
+package autorefresh
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testImage is an AMI seen by the retention policy, newest first in a table.
+type testImage struct {
+	id           string
+	creationDate string
+	state        string
+}
+
+func expiredIds(t *testing.T, policy RetentionPolicy, images []testImage, now time.Time) []string {
+	if err := policy.validateAndSetDefaults(); err != nil {
+		t.Fatalf("Invalid policy %v: %v", policy, err)
+	}
+	amiFound := make([]*AutoAmi, 0)
+	for _, image := range images {
+		ami := AutoAmi{}
+		ami.Id = image.id
+		ami.CreationDate = image.creationDate
+		ami.State = image.state
+		if ami.State == "" {
+			ami.State = "available"
+		}
+		amiFound = append(amiFound, &ami)
+	}
+	ids := make([]string, 0)
+	for _, ami := range policy.Expired(amiFound, now) {
+		ids = append(ids, ami.Id)
+	}
+	return ids
+}
+
+func TestRetentionExpired(t *testing.T) {
+	now := time.Date(2026, 1, 2, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		policy  RetentionPolicy
+		images  []testImage
+		expired []string
+	}{
+		{
+			name:   "keep last",
+			policy: RetentionPolicy{KeepLast: 2},
+			images: []testImage{
+				{"ami-4", "2026-01-01T04:00:00Z", ""},
+				{"ami-3", "2026-01-01T03:00:00Z", ""},
+				{"ami-2", "2026-01-01T02:00:00Z", ""},
+				{"ami-1", "2026-01-01T01:00:00Z", ""},
+			},
+			expired: []string{"ami-1", "ami-2"},
+		},
+		{
+			name:   "keep last ignores an older failed image",
+			policy: RetentionPolicy{KeepLast: 2},
+			images: []testImage{
+				{"ami-5", "2026-01-01T05:00:00Z", ""},
+				{"ami-4", "2026-01-01T04:00:00Z", ""},
+				{"ami-3", "2026-01-01T03:00:00Z", ""},
+				{"ami-2", "2026-01-01T02:00:00Z", "failed"},
+				{"ami-1", "2026-01-01T01:00:00Z", ""},
+			},
+			expired: []string{"ami-1", "ami-3"},
+		},
+		{
+			name:   "keep last counts available images past a newest failed one",
+			policy: RetentionPolicy{KeepLast: 2},
+			images: []testImage{
+				{"ami-4", "2026-01-01T04:00:00Z", "failed"},
+				{"ami-3", "2026-01-01T03:00:00Z", ""},
+				{"ami-2", "2026-01-01T02:00:00Z", ""},
+				{"ami-1", "2026-01-01T01:00:00Z", ""},
+			},
+			expired: []string{"ami-1"},
+		},
+		{
+			name:   "keep last counts available images past failed ones among the newest",
+			policy: RetentionPolicy{KeepLast: 3},
+			images: []testImage{
+				{"ami-5", "2026-01-01T05:00:00Z", ""},
+				{"ami-4", "2026-01-01T04:00:00Z", "failed"},
+				{"ami-3", "2026-01-01T03:00:00Z", "failed"},
+				{"ami-2", "2026-01-01T02:00:00Z", ""},
+				{"ami-1", "2026-01-01T01:00:00Z", ""},
+			},
+			expired: []string{},
+		},
+		{
+			name:   "pending images are never picked",
+			policy: RetentionPolicy{KeepLast: 1},
+			images: []testImage{
+				{"ami-3", "2026-01-01T03:00:00Z", "pending"},
+				{"ami-2", "2026-01-01T02:00:00Z", ""},
+				{"ami-1", "2026-01-01T01:00:00Z", "pending"},
+			},
+			expired: []string{},
+		},
+		{
+			name:   "younger than days",
+			policy: RetentionPolicy{KeepYoungerThan: "2d"},
+			images: []testImage{
+				{"ami-4", "2026-01-01T12:00:00Z", ""},
+				{"ami-3", "2025-12-30T12:00:00Z", ""},
+				{"ami-2", "2025-12-27T12:00:00Z", ""},
+				{"ami-1", "2025-12-25T12:00:00Z", ""},
+			},
+			expired: []string{"ami-1", "ami-2", "ami-3"},
+		},
+		{
+			name:   "younger than weeks",
+			policy: RetentionPolicy{KeepYoungerThan: "1w"},
+			images: []testImage{
+				{"ami-4", "2026-01-01T12:00:00Z", ""},
+				{"ami-3", "2025-12-30T12:00:00Z", ""},
+				{"ami-2", "2025-12-27T12:00:00Z", ""},
+				{"ami-1", "2025-12-25T12:00:00Z", ""},
+			},
+			expired: []string{"ami-1"},
+		},
+		{
+			name:   "daily keeps the newest image of each day",
+			policy: RetentionPolicy{KeepDaily: 2},
+			images: []testImage{
+				{"ami-4", "2026-01-01T04:00:00Z", ""},
+				{"ami-3", "2026-01-01T01:00:00Z", ""},
+				{"ami-2", "2025-12-31T23:00:00Z", ""},
+				{"ami-1", "2025-12-30T23:00:00Z", ""},
+			},
+			expired: []string{"ami-1", "ami-3"},
+		},
+		{
+			name:   "weekly uses ISO weeks across the year boundary",
+			policy: RetentionPolicy{KeepWeekly: 2},
+			images: []testImage{
+				// 2026-W01 starts on Monday 2025-12-29
+				{"ami-5", "2026-01-01T00:00:00Z", ""},
+				{"ami-4", "2025-12-29T00:00:00Z", ""},
+				{"ami-3", "2025-12-28T00:00:00Z", ""},
+				{"ami-2", "2025-12-22T00:00:00Z", ""},
+				{"ami-1", "2025-12-15T00:00:00Z", ""},
+			},
+			expired: []string{"ami-1", "ami-2", "ami-4"},
+		},
+		{
+			name:   "monthly across the year boundary",
+			policy: RetentionPolicy{KeepMonthly: 3},
+			images: []testImage{
+				{"ami-5", "2026-01-01T00:00:00Z", ""},
+				{"ami-4", "2025-12-31T00:00:00Z", ""},
+				{"ami-3", "2025-12-01T00:00:00Z", ""},
+				{"ami-2", "2025-11-30T00:00:00Z", ""},
+				{"ami-1", "2025-10-31T00:00:00Z", ""},
+			},
+			expired: []string{"ami-1", "ami-3"},
+		},
+		{
+			name:   "periods skip images that are not available",
+			policy: RetentionPolicy{KeepDaily: 1},
+			images: []testImage{
+				{"ami-3", "2026-01-01T03:00:00Z", "failed"},
+				{"ami-2", "2026-01-01T02:00:00Z", ""},
+				{"ami-1", "2026-01-01T01:00:00Z", ""},
+			},
+			expired: []string{"ami-1"},
+		},
+		{
+			name:   "rules add up",
+			policy: RetentionPolicy{KeepLast: 1, KeepMonthly: 2},
+			images: []testImage{
+				{"ami-4", "2026-01-01T04:00:00Z", ""},
+				{"ami-3", "2026-01-01T03:00:00Z", ""},
+				{"ami-2", "2025-12-31T00:00:00Z", ""},
+				{"ami-1", "2025-12-01T00:00:00Z", ""},
+			},
+			expired: []string{"ami-1", "ami-3"},
+		},
+		{
+			name:   "unparsable creation date is kept",
+			policy: RetentionPolicy{KeepLast: 1},
+			images: []testImage{
+				{"ami-3", "2026-01-01T03:00:00Z", ""},
+				{"ami-2", "yesterday", ""},
+				{"ami-1", "2026-01-01T01:00:00Z", ""},
+			},
+			expired: []string{"ami-1"},
+		},
+		{
+			name:   "newest available always kept",
+			policy: RetentionPolicy{KeepYoungerThan: "1d"},
+			images: []testImage{
+				{"ami-3", "2025-12-01T03:00:00Z", "pending"},
+				{"ami-2", "2025-12-01T02:00:00Z", ""},
+				{"ami-1", "2025-12-01T01:00:00Z", ""},
+			},
+			expired: []string{"ami-1"},
+		},
+	}
+	for _, test := range tests {
+		expired := expiredIds(t, test.policy, test.images, now)
+		if !reflect.DeepEqual(expired, test.expired) {
+			t.Errorf("%v: expired %v, expected %v", test.name, expired, test.expired)
+		}
+	}
+}
+
+func TestRetentionKeepYoungerThan(t *testing.T) {
+	tests := []struct {
+		value string
+		age   time.Duration
+		valid bool
+	}{
+		{"36h", 36 * time.Hour, true},
+		{"14d", 14 * 24 * time.Hour, true},
+		{"8w", 8 * 7 * 24 * time.Hour, true},
+		{"0d", 0, false},
+		{"2y", 0, false},
+		{"d", 0, false},
+	}
+	for _, test := range tests {
+		policy := RetentionPolicy{KeepYoungerThan: test.value}
+		err := policy.validateAndSetDefaults()
+		if (err == nil) != test.valid {
+			t.Errorf("%v: unexpected error %v", test.value, err)
+			continue
+		}
+		if test.valid && policy.keepYoungerThan != test.age {
+			t.Errorf("%v: parsed as %v, expected %v", test.value, policy.keepYoungerThan, test.age)
+		}
+	}
+}
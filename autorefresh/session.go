@@ -0,0 +1,148 @@
+package autorefresh
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HttpConfig holds the HTTP client settings used for every AWS API call
+// made on behalf of an account.
+type HttpConfig struct {
+	Timeout string
+	Proxy   string
+	timeout time.Duration
+	proxy   *url.URL
+}
+
+func (self *HttpConfig) validateAndSetDefaults() error {
+	self.Timeout = strings.TrimSpace(self.Timeout)
+	self.Proxy = strings.TrimSpace(self.Proxy)
+	if self.Timeout != "" {
+		timeout, err := parseTimeout(self.Timeout)
+		if err != nil {
+			return fmt.Errorf("Invalid Http.Timeout: %v", err)
+		}
+		self.timeout = timeout
+	}
+	if self.Proxy != "" {
+		proxy, err := url.Parse(self.Proxy)
+		if err != nil || proxy.Host == "" {
+			return fmt.Errorf("Invalid Http.Proxy '%v'", self.Proxy)
+		}
+		self.proxy = proxy
+	}
+	return nil
+}
+
+// newClient returns an HTTP client honouring the settings. Without an explicit
+// Proxy the usual HTTP_PROXY/HTTPS_PROXY environment variables apply.
+func (self *HttpConfig) newClient() *http.Client {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		Dial: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).Dial,
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConnsPerHost: 10,
+	}
+	if self.proxy != nil {
+		transport.Proxy = http.ProxyURL(self.proxy)
+	}
+	return &http.Client{Transport: transport, Timeout: self.timeout}
+}
+
+type clientCacheKey struct {
+	account *Account
+	region  string
+}
+
+// clientCache keeps one session and one client per service for every account
+// and region, so connections and credentials are reused by all jobs.
+type clientCache struct {
+	lock      sync.Mutex
+	sessions  map[clientCacheKey]*session.Session
+	ec2Client map[clientCacheKey]Ec2Client
+	s3Client  map[clientCacheKey]S3Client
+	asgClient map[clientCacheKey]AutoscalingClient
+}
+
+var sessionCache = newClientCache()
+
+func newClientCache() *clientCache {
+	cache := clientCache{}
+	cache.sessions = make(map[clientCacheKey]*session.Session)
+	cache.ec2Client = make(map[clientCacheKey]Ec2Client)
+	cache.s3Client = make(map[clientCacheKey]S3Client)
+	cache.asgClient = make(map[clientCacheKey]AutoscalingClient)
+	return &cache
+}
+
+func (self *clientCache) session(key clientCacheKey) (*session.Session, error) {
+	if sess, ok := self.sessions[key]; ok {
+		return sess, nil
+	}
+	sess, err := key.account.newSession(key.region)
+	if err != nil {
+		return nil, err
+	}
+	self.sessions[key] = sess
+	return sess, nil
+}
+
+func (self *clientCache) ec2(account *Account, region string) (Ec2Client, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	key := clientCacheKey{account: account, region: region}
+	if client, ok := self.ec2Client[key]; ok {
+		return client, nil
+	}
+	sess, err := self.session(key)
+	if err != nil {
+		return nil, err
+	}
+	client := ec2.New(sess, account.ec2Config())
+	self.ec2Client[key] = client
+	return client, nil
+}
+
+func (self *clientCache) s3(account *Account, region string) (S3Client, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	key := clientCacheKey{account: account, region: region}
+	if client, ok := self.s3Client[key]; ok {
+		return client, nil
+	}
+	sess, err := self.session(key)
+	if err != nil {
+		return nil, err
+	}
+	client := s3.New(sess)
+	self.s3Client[key] = client
+	return client, nil
+}
+
+func (self *clientCache) autoscaling(account *Account, region string) (AutoscalingClient, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	key := clientCacheKey{account: account, region: region}
+	if client, ok := self.asgClient[key]; ok {
+		return client, nil
+	}
+	sess, err := self.session(key)
+	if err != nil {
+		return nil, err
+	}
+	client := autoscaling.New(sess)
+	self.asgClient[key] = client
+	return client, nil
+}
@@ -0,0 +1,216 @@
+package autorefresh
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"strings"
+	"time"
+)
+
+// TAG_IN_USE is set on an AMI kept past its retention because it is still in
+// use, naming what uses it. It is removed once the AMI is no longer in use.
+const TAG_IN_USE = "__AutoRefreshAmi_InUse__"
+
+// EC2 tag values are limited to 256 characters.
+const TAG_VALUE_MAX_LENGTH = 256
+
+// imagesInUse returns, for every image among ids still referenced in the
+// region, what references it: instances not terminated, the default and
+// latest versions of launch templates, Auto Scaling launch configurations,
+// and the launch template versions Auto Scaling groups launch. Auto Scaling
+// is only checked when Autoscaling is set.
+func (self *AutoAmi) imagesInUse(ids []string) (map[string][]string, error) {
+	users := make(map[string][]string)
+	if len(ids) == 0 {
+		return users, nil
+	}
+	imageIds := aws.StringSlice(ids)
+
+	instanceInput := new(ec2.DescribeInstancesInput)
+	instanceInput.Filters = []*ec2.Filter{
+		{Name: aws.String("image-id"), Values: imageIds},
+		{Name: aws.String("instance-state-name"), Values: aws.StringSlice(
+			[]string{"pending", "running", "stopping", "stopped"})},
+	}
+	instances, err := describeAllInstances(self.Connection, instanceInput)
+	if err != nil {
+		return nil, err
+	}
+	for _, instance := range instances {
+		id := aws.StringValue(instance.ImageId)
+		users[id] = append(users[id], fmt.Sprintf("instance %v", aws.StringValue(instance.InstanceId)))
+	}
+
+	templateInput := new(ec2.DescribeLaunchTemplateVersionsInput)
+	templateInput.Versions = aws.StringSlice([]string{"$Default", "$Latest"})
+	templateInput.Filters = []*ec2.Filter{{Name: aws.String("image-id"), Values: imageIds}}
+	versions, err := describeAllLaunchTemplateVersions(self.Connection, templateInput)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for _, version := range versions {
+		if version.LaunchTemplateData == nil {
+			continue
+		}
+		id := aws.StringValue(version.LaunchTemplateData.ImageId)
+		user := fmt.Sprintf("launch template %v version %v", aws.StringValue(version.LaunchTemplateName),
+			aws.Int64Value(version.VersionNumber))
+		// The default version is usually the latest one as well
+		if seen[user] {
+			continue
+		}
+		seen[user] = true
+		users[id] = append(users[id], user)
+	}
+
+	if self.Autoscaling != nil {
+		configurations, err := describeAllLaunchConfigurations(self.Autoscaling)
+		if err != nil {
+			return nil, err
+		}
+		for _, configuration := range configurations {
+			id := aws.StringValue(configuration.ImageId)
+			if !containsString(imageIds, id) {
+				continue
+			}
+			users[id] = append(users[id], fmt.Sprintf("launch configuration %v",
+				aws.StringValue(configuration.LaunchConfigurationName)))
+		}
+
+		groups, err := describeAllAutoScalingGroups(self.Autoscaling)
+		if err != nil {
+			return nil, err
+		}
+		references := make([]launchTemplateReference, 0)
+		groupNames := make(map[launchTemplateReference][]string)
+		for _, group := range groups {
+			for _, spec := range groupLaunchTemplates(group) {
+				reference := launchTemplateReference{
+					id:      aws.StringValue(spec.LaunchTemplateId),
+					name:    aws.StringValue(spec.LaunchTemplateName),
+					version: aws.StringValue(spec.Version),
+				}
+				// Groups launch the default version unless told otherwise
+				if reference.version == "" {
+					reference.version = "$Default"
+				}
+				if _, ok := groupNames[reference]; !ok {
+					references = append(references, reference)
+				}
+				groupNames[reference] = append(groupNames[reference], aws.StringValue(group.AutoScalingGroupName))
+			}
+		}
+		for _, reference := range references {
+			input := new(ec2.DescribeLaunchTemplateVersionsInput)
+			if reference.id != "" {
+				input.LaunchTemplateId = aws.String(reference.id)
+			} else {
+				input.LaunchTemplateName = aws.String(reference.name)
+			}
+			input.Versions = aws.StringSlice([]string{reference.version})
+			input.Filters = []*ec2.Filter{{Name: aws.String("image-id"), Values: imageIds}}
+			versions, err := describeAllLaunchTemplateVersions(self.Connection, input)
+			if err != nil {
+				return nil, err
+			}
+			for _, version := range versions {
+				if version.LaunchTemplateData == nil {
+					continue
+				}
+				id := aws.StringValue(version.LaunchTemplateData.ImageId)
+				for _, name := range groupNames[reference] {
+					user := fmt.Sprintf("auto scaling group %v (launch template %v version %v)", name,
+						aws.StringValue(version.LaunchTemplateName), aws.Int64Value(version.VersionNumber))
+					if seen[user] {
+						continue
+					}
+					seen[user] = true
+					users[id] = append(users[id], user)
+				}
+			}
+		}
+	}
+	return users, nil
+}
+
+// launchTemplateReference is a launch template version as referenced by an
+// Auto Scaling group, by template id or name.
+type launchTemplateReference struct {
+	id      string
+	name    string
+	version string
+}
+
+// groupLaunchTemplates returns the launch templates an Auto Scaling group
+// launches instances from, including those of its mixed instances policy.
+func groupLaunchTemplates(group *autoscaling.Group) []*autoscaling.LaunchTemplateSpecification {
+	specs := make([]*autoscaling.LaunchTemplateSpecification, 0)
+	if group.LaunchTemplate != nil {
+		specs = append(specs, group.LaunchTemplate)
+	}
+	if group.MixedInstancesPolicy == nil || group.MixedInstancesPolicy.LaunchTemplate == nil {
+		return specs
+	}
+	template := group.MixedInstancesPolicy.LaunchTemplate
+	if template.LaunchTemplateSpecification != nil {
+		specs = append(specs, template.LaunchTemplateSpecification)
+	}
+	for _, override := range template.Overrides {
+		if override.LaunchTemplateSpecification != nil {
+			specs = append(specs, override.LaunchTemplateSpecification)
+		}
+	}
+	return specs
+}
+
+// expiredImages applies policy at time now to amiFound, sorted newest first,
+// and splits the images it expires into those to deregister and those kept
+// because they are still in use. users tells what uses the latter.
+func (self *AutoAmi) expiredImages(amiFound []*AutoAmi, policy *RetentionPolicy, now time.Time) (
+	deregister []*AutoAmi, inUse []*AutoAmi, users map[string][]string, err error) {
+	candidates := policy.Expired(amiFound, now)
+	ids := make([]string, 0)
+	for _, ami := range candidates {
+		ids = append(ids, ami.Id)
+	}
+	users, err = self.imagesInUse(ids)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	deregister = make([]*AutoAmi, 0)
+	inUse = make([]*AutoAmi, 0)
+	for _, ami := range candidates {
+		if len(users[ami.Id]) > 0 {
+			inUse = append(inUse, ami)
+			continue
+		}
+		deregister = append(deregister, ami)
+	}
+	return deregister, inUse, users, nil
+}
+
+// markInUse tags the image with what keeps it from being deregistered.
+func (self *AutoAmi) markInUse(users []string) error {
+	reason := strings.Join(users, ", ")
+	if len(reason) > TAG_VALUE_MAX_LENGTH {
+		reason = reason[:TAG_VALUE_MAX_LENGTH-3] + "..."
+	}
+	marker := AutoAmi{}
+	marker.Id = self.Id
+	marker.Region = self.Region
+	marker.Connection = self.Connection
+	marker.Tags = map[string]string{TAG_IN_USE: reason}
+	return marker.TagImage()
+}
+
+// clearInUse removes TAG_IN_USE from an image no longer in use.
+func (self *AutoAmi) clearInUse() error {
+	input := new(ec2.DeleteTagsInput)
+	input.Resources = append(input.Resources, aws.String(self.Id))
+	input.Tags = append(input.Tags, &ec2.Tag{Key: aws.String(TAG_IN_USE)})
+	_, err := self.Connection.DeleteTags(input)
+	return err
+}
@@ -0,0 +1,138 @@
+package autorefresh
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeleteOldAmiInUse(t *testing.T) {
+	// expired is the image retention expires, current one it keeps
+	tests := []struct {
+		name      string
+		configure func(fake *FakeEc2, groups *FakeAutoscaling, expired string, current string)
+		user      string
+	}{
+		{"running instance", func(fake *FakeEc2, groups *FakeAutoscaling, expired string, current string) {
+			fake.AddInstance(&ec2.Instance{ImageId: aws.String(expired),
+				State: &ec2.InstanceState{Name: aws.String("running")}})
+		}, "instance i-"},
+		{"stopped instance", func(fake *FakeEc2, groups *FakeAutoscaling, expired string, current string) {
+			fake.AddInstance(&ec2.Instance{ImageId: aws.String(expired),
+				State: &ec2.InstanceState{Name: aws.String("stopped")}})
+		}, "instance i-"},
+		{"terminated instance", func(fake *FakeEc2, groups *FakeAutoscaling, expired string, current string) {
+			fake.AddInstance(&ec2.Instance{ImageId: aws.String(expired),
+				State: &ec2.InstanceState{Name: aws.String("terminated")}})
+		}, ""},
+		{"launch template default version", func(fake *FakeEc2, groups *FakeAutoscaling, expired string, current string) {
+			templateId := fake.AddLaunchTemplate("web", expired)
+			fake.AddLaunchTemplateVersion(templateId, current, false)
+		}, "launch template web version 1"},
+		{"launch template latest version", func(fake *FakeEc2, groups *FakeAutoscaling, expired string, current string) {
+			templateId := fake.AddLaunchTemplate("web", current)
+			fake.AddLaunchTemplateVersion(templateId, expired, false)
+		}, "launch template web version 2"},
+		{"launch template older version", func(fake *FakeEc2, groups *FakeAutoscaling, expired string, current string) {
+			templateId := fake.AddLaunchTemplate("web", expired)
+			fake.AddLaunchTemplateVersion(templateId, current, true)
+		}, ""},
+		{"launch configuration", func(fake *FakeEc2, groups *FakeAutoscaling, expired string, current string) {
+			groups.AddLaunchConfiguration("web-lc", expired)
+		}, "launch configuration web-lc"},
+		{"auto scaling group pinning a version", func(fake *FakeEc2, groups *FakeAutoscaling, expired string, current string) {
+			templateId := fake.AddLaunchTemplate("web", expired)
+			fake.AddLaunchTemplateVersion(templateId, current, true)
+			groups.AddAutoScalingGroup(&autoscaling.Group{
+				AutoScalingGroupName: aws.String("web-asg"),
+				LaunchTemplate: &autoscaling.LaunchTemplateSpecification{
+					LaunchTemplateId: aws.String(templateId),
+					Version:          aws.String("1"),
+				},
+			})
+		}, "auto scaling group web-asg (launch template web version 1)"},
+		{"auto scaling group mixed instances policy", func(fake *FakeEc2, groups *FakeAutoscaling, expired string, current string) {
+			templateId := fake.AddLaunchTemplate("web", expired)
+			fake.AddLaunchTemplateVersion(templateId, current, true)
+			groups.AddAutoScalingGroup(&autoscaling.Group{
+				AutoScalingGroupName: aws.String("web-mixed"),
+				MixedInstancesPolicy: &autoscaling.MixedInstancesPolicy{
+					LaunchTemplate: &autoscaling.LaunchTemplate{
+						LaunchTemplateSpecification: &autoscaling.LaunchTemplateSpecification{
+							LaunchTemplateName: aws.String("web"),
+							Version:            aws.String("1"),
+						},
+					},
+				},
+			})
+		}, "auto scaling group web-mixed (launch template web version 1)"},
+		{"nothing", func(fake *FakeEc2, groups *FakeAutoscaling, expired string, current string) {}, ""},
+	}
+	for _, test := range tests {
+		fake := NewFakeEc2("111111111111")
+		groups := NewFakeAutoscaling()
+		job := newTestJob(t, fake)
+		job.Account.AutoscalingFactory = groups.Factory()
+		job.Retention = RetentionPolicy{KeepLast: 1}
+		created := time.Now().UTC().Add(-72 * time.Hour)
+		expired := fake.AddImage(&ec2.Image{
+			CreationDate: aws.String(created.Format(time.RFC3339)),
+			Tags:         testTags(job.LaunchConfig.Tags),
+		})
+		// Marked in use by an earlier run, nothing uses it anymore
+		tags := CopyMap(&job.LaunchConfig.Tags)
+		tags[TAG_IN_USE] = "instance i-gone"
+		current := fake.AddImage(&ec2.Image{
+			CreationDate: aws.String(created.Add(time.Hour).Format(time.RFC3339)),
+			Tags:         testTags(tags),
+		})
+		test.configure(fake, groups, expired, current)
+
+		deleted, err := job.Prune(context.Background(), false)
+		os.RemoveAll(job.ConsoleOutput.Directory)
+		if err != nil {
+			t.Errorf("%v: Prune failed: %v", test.name, err)
+			continue
+		}
+		image := fake.Image(expired)
+		if test.user == "" {
+			if image != nil || len(deleted) != 1 {
+				t.Errorf("%v: AMI %v not deregistered, deleted %v", test.name, expired, deleted)
+			}
+		} else if image == nil || len(deleted) != 0 {
+			t.Errorf("%v: AMI %v in use deregistered", test.name, expired)
+		} else if reason := aws.StringValue(imageTag(image, TAG_IN_USE)); !strings.Contains(reason, test.user) {
+			t.Errorf("%v: AMI %v tagged in use by %q, expected %q", test.name, expired, reason, test.user)
+		}
+		if reason := imageTag(fake.Image(current), TAG_IN_USE); reason != nil {
+			t.Errorf("%v: AMI %v no longer in use still tagged %q", test.name, current, aws.StringValue(reason))
+		}
+	}
+}
+
+func TestPruneEc2Endpoint(t *testing.T) {
+	fake := NewFakeEc2("111111111111")
+	job := newTestJob(t, fake)
+	defer os.RemoveAll(job.ConsoleOutput.Directory)
+	job.Account.AutoscalingFactory = nil
+	job.Account.Ec2Endpoint = "http://127.0.0.1:1"
+	job.Retention = RetentionPolicy{KeepLast: 1}
+	created := time.Now().UTC().Add(-72 * time.Hour)
+	for i := 0; i < 2; i++ {
+		fake.AddImage(&ec2.Image{
+			CreationDate: aws.String(created.Add(time.Duration(i) * time.Hour).Format(time.RFC3339)),
+			Tags:         testTags(job.LaunchConfig.Tags),
+		})
+	}
+
+	// Auto Scaling is not served by the endpoint, only EC2 users are checked
+	deleted, err := job.Prune(context.Background(), false)
+	if err != nil || len(deleted) != 1 {
+		t.Errorf("Deleted %v, error %v", deleted, err)
+	}
+}
@@ -1,5 +1,10 @@
 package autorefresh
 
+import (
+	"context"
+	"time"
+)
+
 func CopyMap(source *map[string]string) map[string]string {
 	newMap := make(map[string]string)
 	for k, v := range *source {
@@ -7,3 +12,22 @@ func CopyMap(source *map[string]string) map[string]string {
 	}
 	return newMap
 }
+
+// withOptionalTimeout applies timeout to ctx, a zero timeout means no limit.
+func withOptionalTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func sleepWithContext(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
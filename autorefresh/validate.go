@@ -0,0 +1,62 @@
+package autorefresh
+
+import (
+	"fmt"
+)
+
+// configDuplicate is a config entry whose name was already taken by an entry
+// loaded earlier. Only the first definition is kept.
+type configDuplicate struct {
+	configType string
+	name       string
+	first      configOrigin
+	second     configOrigin
+	conflict   bool
+}
+
+func (self *configDuplicate) Error() string {
+	if self.conflict {
+		return fmt.Sprintf("Conflicting definitions of %v '%v', first defined at %v",
+			self.configType, self.name, self.first)
+	}
+	return fmt.Sprintf("%v '%v' defined more than once, first defined at %v",
+		self.configType, self.name, self.first)
+}
+
+// addDuplicate remembers a second definition of name. The definitions
+// conflict unless they are identical once loaded.
+func (self *ConfigStorage) addDuplicate(configType string, name string, first configOrigin,
+	second configOrigin, identical bool) {
+	duplicate := configDuplicate{
+		configType: configType,
+		name:       name,
+		first:      first,
+		second:     second,
+		conflict:   !identical,
+	}
+	self.duplicates = append(self.duplicates, duplicate)
+}
+
+// validateReferences runs once every file is loaded. It reports duplicate and
+// conflicting definitions, projects referring to an Account or UserData that
+// is not defined, and projects whose SourceFilter matches no Source.
+func (self *ConfigStorage) validateReferences() {
+	for index := range self.duplicates {
+		duplicate := &self.duplicates[index]
+		self.recordErrorAt("Duplicate Definition", duplicate.second, duplicate)
+	}
+	for _, project := range self.sortedProjects() {
+		if _, ok := self.accounts[project.Account]; !ok {
+			err := fmt.Errorf("Project '%v' refers to undefined Account '%v'", project.Name, project.Account)
+			self.recordErrorAt("Reference Validation", project.origin, err)
+		}
+		if _, ok := self.userdatas[project.UserData]; !ok {
+			err := fmt.Errorf("Project '%v' refers to undefined UserData '%v'", project.Name, project.UserData)
+			self.recordErrorAt("Reference Validation", project.origin, err)
+		}
+		if len(project.SourceFilter.findSources(&self.sources)) == 0 {
+			err := fmt.Errorf("SourceFilter of Project '%v' matches no Source", project.Name)
+			self.recordErrorAt("Reference Validation", project.origin, err)
+		}
+	}
+}
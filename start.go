@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/codegangsta/cli"
 	"github.com/rohit01/auto-refresh-ami/autorefresh"
 	"os"
 	"strings"
+	"time"
 )
 
 const VERSION = "v1.1"
@@ -14,11 +17,19 @@ const VERSION = "v1.1"
 type Arguments struct {
 	configPath string
 	loglevel   string
+	lenient    bool
+	format     string
+	project    string
+	region     string
+	sourceAmi  string
+	dryRun     bool
+	formats    []string
 }
 
 func (self *Arguments) Validate() error {
 	self.configPath = strings.TrimSpace(self.configPath)
 	self.loglevel = strings.TrimSpace(self.loglevel)
+	self.format = strings.ToLower(strings.TrimSpace(self.format))
 
 	if self.configPath == "" {
 		msg := "Mandatory field missing: -c/--config. Use -h/--help for instructions"
@@ -32,14 +43,23 @@ func (self *Arguments) Validate() error {
 		msg := fmt.Sprintf("Invalid loglevel: %v. Use -h/--help for instructions", self.loglevel)
 		return errors.New(msg)
 	}
-	return nil
+	if len(self.formats) == 0 {
+		return nil
+	}
+	if self.format == "" {
+		self.format = self.formats[0]
+	}
+	for _, format := range self.formats {
+		if self.format == format {
+			return nil
+		}
+	}
+	msg := fmt.Sprintf("Invalid format: %v. Use -h/--help for instructions", self.format)
+	return errors.New(msg)
 }
 
-func main() {
-	arguments := Arguments{}
-
-	app := cli.NewApp()
-	app.Flags = []cli.Flag{
+func configFlags(arguments *Arguments) []cli.Flag {
+	return []cli.Flag{
 		cli.StringFlag{
 			Name:        "c,config",
 			Value:       "",
@@ -52,7 +72,275 @@ func main() {
 			Usage:       "loglevel (Panic, Fatal, Error, Warn, Info & Debug). Default: Info",
 			Destination: &arguments.loglevel,
 		},
+		cli.BoolFlag{
+			Name:        "lenient",
+			Usage:       "Warn about unknown config types and fields instead of failing",
+			Destination: &arguments.lenient,
+		},
+	}
+}
+
+// formatFlag accepts one of formats, the first one being the default.
+func formatFlag(arguments *Arguments, formats ...string) cli.Flag {
+	arguments.formats = formats
+	return cli.StringFlag{
+		Name:        "f,format",
+		Value:       "",
+		Usage:       fmt.Sprintf("Output format (%v). Default: %v", strings.Join(formats, ", "), formats[0]),
+		Destination: &arguments.format,
+	}
+}
+
+func exitWithError(err error, status int) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(status)
+}
+
+func loadConfig(arguments *Arguments) (*autorefresh.ConfigStorage, error) {
+	if err := arguments.Validate(); err != nil {
+		exitWithError(err, 2)
+	}
+	autorefresh.InitLogger(arguments.loglevel)
+	cs := autorefresh.ConfigStorage{Lenient: arguments.lenient}
+	err := cs.ProcessDirectory(arguments.configPath)
+	return &cs, err
+}
+
+func validateCommand(arguments *Arguments) cli.Command {
+	return cli.Command{
+		Name:  "validate",
+		Usage: "Load and validate the config, and report each project's sources",
+		Flags: append(configFlags(arguments), formatFlag(arguments, "text", "json")),
+		Action: func(c *cli.Context) {
+			cs, err := loadConfig(arguments)
+			report := cs.Report(arguments.configPath)
+			if arguments.format == "json" {
+				report.WriteJson(os.Stdout)
+			} else {
+				report.WriteText(os.Stdout)
+			}
+			if err != nil {
+				os.Exit(1)
+			}
+		},
+	}
+}
+
+func planCommand(arguments *Arguments) cli.Command {
+	return cli.Command{
+		Name:  "plan",
+		Usage: "Show what the engine would schedule and which AMIs retention would deregister",
+		Flags: append(configFlags(arguments), formatFlag(arguments, "text", "json")),
+		Action: func(c *cli.Context) {
+			cs, err := loadConfig(arguments)
+			if err != nil {
+				exitWithError(err, 1)
+			}
+			report := cs.Plan(arguments.configPath, time.Now())
+			if arguments.format == "json" {
+				report.WriteJson(os.Stdout)
+			} else {
+				report.WriteText(os.Stdout)
+			}
+			if report.Failed() {
+				os.Exit(1)
+			}
+		},
 	}
+}
+
+func buildCommand(arguments *Arguments) cli.Command {
+	return cli.Command{
+		Name:  "build",
+		Usage: "Refresh the AMIs of one project right away and print their IDs",
+		Description: "Exit status is 0 when every AMI was built, 1 when a build failed, " +
+			"2 on config or usage errors and 3 when interrupted.",
+		Flags: append(configFlags(arguments),
+			formatFlag(arguments, "text", "json"),
+			cli.StringFlag{
+				Name:        "p,project",
+				Value:       "",
+				Usage:       "Name of the project to build",
+				Destination: &arguments.project,
+			},
+			cli.StringFlag{
+				Name:        "r,region",
+				Value:       "",
+				Usage:       "Only build the sources of this region",
+				Destination: &arguments.region,
+			},
+			cli.StringFlag{
+				Name:        "source-ami",
+				Value:       "",
+				Usage:       "Only build from this source AMI ID",
+				Destination: &arguments.sourceAmi,
+			},
+		),
+		Action: func(c *cli.Context) {
+			cs, err := loadConfig(arguments)
+			if err != nil {
+				exitWithError(err, 2)
+			}
+			project := strings.TrimSpace(arguments.project)
+			if project == "" {
+				exitWithError(errors.New("Mandatory field missing: -p/--project. Use -h/--help for instructions"), 2)
+			}
+			results, err := autorefresh.BuildProject(context.Background(), cs, project,
+				strings.TrimSpace(arguments.region), strings.TrimSpace(arguments.sourceAmi))
+			if autorefresh.KindOf(err) == autorefresh.ConfigError {
+				exitWithError(err, 2)
+			}
+			if arguments.format == "json" {
+				b, _ := json.MarshalIndent(results, "", "    ")
+				fmt.Println(string(b))
+			} else {
+				for _, result := range results {
+					if result.AmiId != "" && result.FailureReason == "" {
+						fmt.Printf("%v\t%v\t%v\t%v\n", result.Project, result.Region, result.SourceAmiId, result.AmiId)
+					} else {
+						fmt.Fprintf(os.Stderr, "%v\t%v\t%v\tFAILED: %v\n", result.Project, result.Region,
+							result.SourceAmiId, result.FailureReason)
+					}
+				}
+			}
+			if failures, ok := err.(autorefresh.ErrorList); ok {
+				for _, failure := range failures {
+					if autorefresh.KindOf(failure) == autorefresh.CanceledError {
+						os.Exit(3)
+					}
+				}
+				os.Exit(1)
+			}
+		},
+	}
+}
+
+func listCommand(arguments *Arguments) cli.Command {
+	return cli.Command{
+		Name:  "list",
+		Usage: "List the AMIs maintained for each project and region",
+		Flags: append(configFlags(arguments),
+			formatFlag(arguments, "table", "json", "csv"),
+			cli.StringFlag{
+				Name:        "p,project",
+				Value:       "",
+				Usage:       "Only list the AMIs of this project",
+				Destination: &arguments.project,
+			},
+		),
+		Action: func(c *cli.Context) {
+			cs, err := loadConfig(arguments)
+			if err != nil {
+				exitWithError(err, 2)
+			}
+			inventory, err := cs.ListAmis(strings.TrimSpace(arguments.project))
+			if autorefresh.KindOf(err) == autorefresh.ConfigError {
+				exitWithError(err, 2)
+			}
+			switch arguments.format {
+			case "json":
+				inventory.WriteJson(os.Stdout)
+			case "csv":
+				inventory.WriteCsv(os.Stdout)
+			default:
+				inventory.WriteText(os.Stdout)
+			}
+			if err != nil {
+				exitWithError(err, 1)
+			}
+		},
+	}
+}
+
+func pruneCommand(arguments *Arguments) cli.Command {
+	return cli.Command{
+		Name:  "prune",
+		Usage: "Deregister the AMIs each project's retention policy no longer keeps, without building",
+		Flags: append(configFlags(arguments),
+			formatFlag(arguments, "table", "json", "csv"),
+			cli.StringFlag{
+				Name:        "p,project",
+				Value:       "",
+				Usage:       "Only prune the AMIs of this project",
+				Destination: &arguments.project,
+			},
+			cli.BoolFlag{
+				Name:        "dry-run",
+				Usage:       "Only list the AMIs that would be deregistered",
+				Destination: &arguments.dryRun,
+			},
+		),
+		Action: func(c *cli.Context) {
+			cs, err := loadConfig(arguments)
+			if err != nil {
+				exitWithError(err, 2)
+			}
+			pruned, err := cs.PruneAmis(context.Background(), strings.TrimSpace(arguments.project), arguments.dryRun)
+			if autorefresh.KindOf(err) == autorefresh.ConfigError {
+				exitWithError(err, 2)
+			}
+			switch arguments.format {
+			case "json":
+				pruned.WriteJson(os.Stdout)
+			case "csv":
+				pruned.WriteCsv(os.Stdout)
+			default:
+				pruned.WriteText(os.Stdout)
+			}
+			if err != nil {
+				exitWithError(err, 1)
+			}
+		},
+	}
+}
+
+func migrateCommand(arguments *Arguments) cli.Command {
+	return cli.Command{
+		Name:  "migrate",
+		Usage: "Add project and source identity tags to AMIs created by older versions",
+		Flags: append(configFlags(arguments),
+			formatFlag(arguments, "table", "json", "csv"),
+			cli.StringFlag{
+				Name:        "p,project",
+				Value:       "",
+				Usage:       "Only migrate the AMIs of this project",
+				Destination: &arguments.project,
+			},
+			cli.BoolFlag{
+				Name:        "dry-run",
+				Usage:       "Only list the AMIs that would be tagged",
+				Destination: &arguments.dryRun,
+			},
+		),
+		Action: func(c *cli.Context) {
+			cs, err := loadConfig(arguments)
+			if err != nil {
+				exitWithError(err, 2)
+			}
+			migrated, err := cs.MigrateAmis(context.Background(), strings.TrimSpace(arguments.project), arguments.dryRun)
+			if autorefresh.KindOf(err) == autorefresh.ConfigError {
+				exitWithError(err, 2)
+			}
+			switch arguments.format {
+			case "json":
+				migrated.WriteJson(os.Stdout)
+			case "csv":
+				migrated.WriteCsv(os.Stdout)
+			default:
+				migrated.WriteText(os.Stdout)
+			}
+			if err != nil {
+				exitWithError(err, 1)
+			}
+		},
+	}
+}
+
+func main() {
+	arguments := Arguments{}
+
+	app := cli.NewApp()
+	app.Flags = configFlags(&arguments)
 	app.Version = VERSION
 	app.Action = func(c *cli.Context) {
 		err := arguments.Validate()
@@ -60,9 +348,20 @@ func main() {
 			panic(err)
 		}
 		autorefresh.InitLogger(arguments.loglevel)
-		cs := autorefresh.ConfigStorage{}
-		cs.ProcessDirectory(arguments.configPath)
-		autorefresh.StartEngine(&cs)
+		cs := autorefresh.ConfigStorage{Lenient: arguments.lenient}
+		if err := cs.ProcessDirectory(arguments.configPath); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		autorefresh.StartEngine(context.Background(), &cs)
+	}
+	app.Commands = []cli.Command{
+		validateCommand(&Arguments{}),
+		planCommand(&Arguments{}),
+		buildCommand(&Arguments{}),
+		listCommand(&Arguments{}),
+		pruneCommand(&Arguments{}),
+		migrateCommand(&Arguments{}),
 	}
 	app.Run(os.Args)
 }